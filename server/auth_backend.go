@@ -1,6 +1,9 @@
 package server
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
 	"errors"
 	"fmt"
 
@@ -14,6 +17,68 @@ type AuthBackend interface {
 	Login(state *smtp.State, username string, password string) (User, error)
 }
 
+// SecretAuthBackend is an optional capability of an AuthBackend for challenge-response
+// mechanisms like CRAM-MD5 that need the plaintext secret of a user.
+type SecretAuthBackend interface {
+	// Secret returns the user and its shared secret.
+	// returns ErrInvalidCredentials if the user doesn't exist.
+	Secret(state *smtp.State, username string) (User, string, error)
+}
+
+// SCRAMAuthBackend is an optional capability of an AuthBackend for the SCRAM-SHA-256 mechanisms.
+type SCRAMAuthBackend interface {
+	// SCRAMCredentials returns the user and its stored SCRAM-SHA-256 credentials.
+	// returns ErrInvalidCredentials if the user doesn't exist.
+	SCRAMCredentials(state *smtp.State, username string) (User, SCRAMCredentials, error)
+}
+
+// SCRAMCredentials are the credentials a server stores for a SCRAM user (RFC 5802 3).
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSCRAMCredentials derives the SCRAM-SHA-256 credentials for a password.
+func NewSCRAMCredentials(password string, salt []byte, iterations int) SCRAMCredentials {
+	saltedPassword := scramHi([]byte(password), salt, iterations)
+	clientKey := scramHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	return SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(saltedPassword, []byte("Server Key")),
+	}
+}
+
+// TokenValidator represents a pluggable backend for the OAUTHBEARER and XOAUTH2 mechanisms
+// which validates OAuth 2.0 bearer tokens (RFC 6750).
+type TokenValidator interface {
+	// ValidateToken checks whether the bearer token is valid for the given username.
+	// The username is empty if the client didn't send one.
+	// returns ErrInvalidCredentials if the token is not valid.
+	ValidateToken(state *smtp.State, username string, token string) (User, error)
+}
+
+// CertificateMapper represents a pluggable backend for the EXTERNAL mechanism
+// which maps a verified TLS client certificate to a user.
+type CertificateMapper interface {
+	// MapCertificate returns the user of the verified certificate chain.
+	// The first certificate of the chain is the client certificate.
+	// returns ErrInvalidCredentials if the certificate doesn't belong to a user.
+	MapCertificate(state *smtp.State, chain []*x509.Certificate) (User, error)
+}
+
+// Authorizer represents a pluggable policy which decides whether an authenticated user
+// may act as another user, the authorization identity requested with AUTH (RFC 4422 2).
+type Authorizer interface {
+	// Authorize returns the user to act as when the authenticated user requests the authorization identity.
+	// returns ErrNotAuthorized if the user may not act as the authorization identity.
+	Authorize(state *smtp.State, user User, authorizationIdentity string) (User, error)
+}
+
 // User denotes an authenticated SMTP user.
 type User interface {
 	Username() string
@@ -30,9 +95,26 @@ func (u *SMTPUser) Username() string {
 	return u.username
 }
 
+// AuthorizedUser is an authenticated user acting as another user.
+// Username returns the username of the user it acts as.
+type AuthorizedUser struct {
+	// Authenticated is the user whose credentials were used.
+	Authenticated User
+	// Authorized is the user it acts as.
+	Authorized User
+}
+
+// Username returns the username of the authorized user
+func (u *AuthorizedUser) Username() string {
+	return u.Authorized.Username()
+}
+
 // ErrInvalidCredentials denotes incorrect credentials.
 var ErrInvalidCredentials = errors.New("InvalidCredentialsError")
 
+// ErrNotAuthorized denotes a user which may not act as the requested user.
+var ErrNotAuthorized = errors.New("NotAuthorizedError")
+
 // AuthBackendMemory is a simple in-memory implementation of AuthBackend for testing purpose.
 type AuthBackendMemory struct {
 	Credentials map[string]string
@@ -52,9 +134,58 @@ func (auth *AuthBackendMemory) Login(state *smtp.State, username string, passwor
 	return nil, ErrInvalidCredentials
 }
 
+// Secret returns the password of a user
+func (auth *AuthBackendMemory) Secret(state *smtp.State, username string) (User, string, error) {
+	if auth.Credentials == nil {
+		return nil, "", fmt.Errorf("auth backend not initialized")
+	}
+	password, ok := auth.Credentials[username]
+	if !ok {
+		return nil, "", ErrInvalidCredentials
+	}
+	return &SMTPUser{username: username}, password, nil
+}
+
+// SCRAMCredentials derives the SCRAM-SHA-256 credentials of a user with a random salt
+func (auth *AuthBackendMemory) SCRAMCredentials(state *smtp.State, username string) (User, SCRAMCredentials, error) {
+	user, password, err := auth.Secret(state, username)
+	if err != nil {
+		return nil, SCRAMCredentials{}, err
+	}
+	salt := make([]byte, 16)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, SCRAMCredentials{}, err
+	}
+	return user, NewSCRAMCredentials(password, salt, 4096), nil
+}
+
 // NewAuthBackendMemory creates a new in-memory AuthBackend
 func NewAuthBackendMemory(credentials map[string]string) *AuthBackendMemory {
 	return &AuthBackendMemory{
 		Credentials: credentials,
 	}
 }
+
+// AuthorizerMemory is a simple in-memory implementation of Authorizer for testing purpose.
+type AuthorizerMemory struct {
+	// Delegations maps a username to the usernames it may act as.
+	Delegations map[string][]string
+}
+
+// Authorize checks whether the user may act as the authorization identity
+func (auth *AuthorizerMemory) Authorize(state *smtp.State, user User, authorizationIdentity string) (User, error) {
+	for _, delegation := range auth.Delegations[user.Username()] {
+		if delegation == authorizationIdentity {
+			return &SMTPUser{username: authorizationIdentity}, nil
+		}
+	}
+	return nil, ErrNotAuthorized
+}
+
+// NewAuthorizerMemory creates a new in-memory Authorizer
+func NewAuthorizerMemory(delegations map[string][]string) *AuthorizerMemory {
+	return &AuthorizerMemory{
+		Delegations: delegations,
+	}
+}
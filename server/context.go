@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/mistralmail/smtp/smtp"
+)
+
+// ContextHandler is a Handler which gets a context when a mail was received.
+// The context is cancelled when the client disconnects or the server stops,
+// and has a deadline if Config.HandlerTimeout or Config.Timeouts.DataTermination is set.
+type ContextHandler interface {
+	HandleContext(ctx context.Context, state *smtp.State) error
+}
+
+// ContextHandlerFunc is a wrapper to allow normal functions to be used as a context handler.
+// It also implements Handler so it can be passed to New.
+type ContextHandlerFunc func(context.Context, *smtp.State) error
+
+func (h ContextHandlerFunc) HandleContext(ctx context.Context, state *smtp.State) error {
+	return h(ctx, state)
+}
+
+// Handle calls the function with a background context.
+func (h ContextHandlerFunc) Handle(state *smtp.State) error {
+	return h(context.Background(), state)
+}
+
+type contextKey int
+
+const sessionIdKey contextKey = 0
+
+// SessionIdFromContext returns the session id of the context of a ContextHandler.
+func SessionIdFromContext(ctx context.Context) (smtp.Id, bool) {
+	id, ok := ctx.Value(sessionIdKey).(smtp.Id)
+	return id, ok
+}
+
+// handle calls the MailHandler, with a context if it is a ContextHandler or a StreamHandler.
+// The message is the reader of a StreamHandler, nil if the message is in State.Data.
+func (s *Server) handle(ctx context.Context, proto smtp.Protocol, state *smtp.State, message io.Reader) error {
+	streamHandler, isStreamHandler := s.MailHandler.(StreamHandler)
+	contextHandler, isContextHandler := s.MailHandler.(ContextHandler)
+	if !isStreamHandler && !isContextHandler {
+		return s.MailHandler.Handle(state)
+	}
+
+	// While the message is streamed the handler reads from the connection itself,
+	// a disconnect is then returned by the reader.
+	if watcher, ok := proto.(smtp.DisconnectWatcher); ok && message == nil {
+		var stop func()
+		ctx, stop = watcher.WatchDisconnect(ctx)
+		defer stop()
+	}
+
+	if timeout := s.handlerTimeout(message); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if isStreamHandler {
+		if message == nil {
+			message = bytes.NewReader(state.Data)
+		}
+		return streamHandler.HandleStream(ctx, state, message)
+	}
+	return contextHandler.HandleContext(ctx, state)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mistralmail/smtp/smtp"
+	log "github.com/sirupsen/logrus"
+)
+
+// QueueRunner starts the delivery of queued mail for the ETRN command (RFC 1985).
+type QueueRunner interface {
+	// StartQueue starts the delivery of the mail queued for the node of the EtrnCmd.
+	// It returns the status and, for QueuePending, the number of messages if it is known.
+	// It returns ErrQueueUnavailable if the mail can't be queued and ErrNodeNotAllowed
+	// if the client may not start the queue of the node.
+	StartQueue(state *smtp.State, node string) (status QueueStatus, messages int, err error)
+}
+
+// QueueStatus is the status of a queue started by a QueueRunner.
+type QueueStatus int
+
+const (
+	// QueueStarted means delivery of the queue was started (250).
+	QueueStarted QueueStatus = iota
+	// QueueEmpty means there are no messages waiting for the node (251).
+	QueueEmpty
+	// QueuePending means delivery of messages waiting for the node was started (252),
+	// or 253 with the number of messages if it is known.
+	QueuePending
+)
+
+// ErrQueueUnavailable is returned by a QueueRunner when the mail for a node can't be queued
+var ErrQueueUnavailable = errors.New("QueueUnavailableError")
+
+// ErrNodeNotAllowed is returned by a QueueRunner when the client may not start the queue of a node
+var ErrNodeNotAllowed = errors.New("NodeNotAllowedError")
+
+// handleEtrn handles the ETRN command.
+func (s *Server) handleEtrn(proto smtp.Protocol, state *smtp.State, cmd smtp.EtrnCmd) {
+	if s.QueueRunner == nil {
+		proto.Send(smtp.Answer{
+			Status:       smtp.NotImplemented,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+			Message:      "Command not implemented",
+		})
+		return
+	}
+
+	status, messages, err := s.QueueRunner.StartQueue(state, cmd.Node)
+	switch {
+	case err == ErrQueueUnavailable:
+		proto.Send(smtp.Answer{
+			Status:       smtp.UnableToQueueMessages,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      fmt.Sprintf("Unable to queue messages for node %s", cmd.Node),
+		})
+	case err == ErrNodeNotAllowed:
+		proto.Send(smtp.Answer{
+			Status:       smtp.NodeNotAllowed,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+			Message:      fmt.Sprintf("Node %s not allowed", cmd.Node),
+		})
+	case err != nil:
+		if smtpErr, ok := err.(smtp.SMTPError); ok {
+			proto.Send(smtp.Answer(smtpErr))
+			break
+		}
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+			"Ip":        state.Ip.String(),
+		}).Errorf("couldn't start queue for node %s: %v", cmd.Node, err)
+		proto.Send(smtp.Answer{
+			Status:       smtp.UnableToQueueMessages,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      fmt.Sprintf("Unable to queue messages for node %s", cmd.Node),
+		})
+	case status == QueueEmpty:
+		proto.Send(smtp.Answer{
+			Status:       smtp.NoMessagesWaiting,
+			EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+			Message:      fmt.Sprintf("OK, no messages waiting for node %s", cmd.Node),
+		})
+	case status == QueuePending && messages > 0:
+		proto.Send(smtp.Answer{
+			Status:       smtp.MessagesStarted,
+			EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+			Message:      fmt.Sprintf("OK, %d pending messages for node %s started", messages, cmd.Node),
+		})
+	case status == QueuePending:
+		proto.Send(smtp.Answer{
+			Status:       smtp.PendingMessagesStarted,
+			EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+			Message:      fmt.Sprintf("OK, pending messages for node %s started", cmd.Node),
+		})
+	default:
+		proto.Send(smtp.Answer{
+			Status:       smtp.QueuingStarted,
+			EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+			Message:      fmt.Sprintf("OK, queuing for node %s started", cmd.Node),
+		})
+	}
+}
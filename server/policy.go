@@ -0,0 +1,95 @@
+package server
+
+import (
+	"github.com/mistralmail/smtp/smtp"
+	log "github.com/sirupsen/logrus"
+)
+
+// The policies are called at each stage of a session, before the command is accepted.
+// A policy accepts by returning nil. It rejects by returning an smtp.SMTPError, which is sent
+// to the client as is, e.g. smtp.SMTPErrorPermanentMailboxNotAvailable for an unknown recipient.
+// Any other error is logged and the client gets a temporary failure.
+
+// ConnectPolicy is called when a client connects, before the greeting is sent.
+// The connection is closed if the client is rejected.
+type ConnectPolicy interface {
+	CheckConnect(state *smtp.State) error
+}
+
+// HeloPolicy is called for the HELO, EHLO and LHLO commands.
+type HeloPolicy interface {
+	CheckHelo(state *smtp.State, domain string) error
+}
+
+// MailPolicy is called for the MAIL command, state.From isn't set yet.
+type MailPolicy interface {
+	CheckMail(state *smtp.State, cmd smtp.MailCmd) error
+}
+
+// RcptPolicy is called for every RCPT command, the recipient isn't added to state.To yet.
+type RcptPolicy interface {
+	CheckRcpt(state *smtp.State, cmd smtp.RcptCmd) error
+}
+
+// DataPolicy is called for the DATA command before the message is received,
+// or for the first BDAT chunk. The transaction is aborted if it is rejected.
+type DataPolicy interface {
+	CheckData(state *smtp.State) error
+}
+
+func (s *Server) checkConnect(state *smtp.State) error {
+	if s.ConnectPolicy == nil {
+		return nil
+	}
+	return s.ConnectPolicy.CheckConnect(state)
+}
+
+func (s *Server) checkHelo(state *smtp.State, domain string) error {
+	if s.HeloPolicy == nil {
+		return nil
+	}
+	return s.HeloPolicy.CheckHelo(state, domain)
+}
+
+func (s *Server) checkMail(state *smtp.State, cmd smtp.MailCmd) error {
+	if s.MailPolicy == nil {
+		return nil
+	}
+	return s.MailPolicy.CheckMail(state, cmd)
+}
+
+func (s *Server) checkRcpt(state *smtp.State, cmd smtp.RcptCmd) error {
+	if s.RcptPolicy == nil {
+		return nil
+	}
+	return s.RcptPolicy.CheckRcpt(state, cmd)
+}
+
+func (s *Server) checkData(state *smtp.State) error {
+	if s.DataPolicy == nil {
+		return nil
+	}
+	return s.DataPolicy.CheckData(state)
+}
+
+// policyAnswer returns the answer for an error of a policy.
+func (s *Server) policyAnswer(state *smtp.State, err error) smtp.Answer {
+	smtpErr, ok := err.(smtp.SMTPError)
+	if !ok {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+			"Ip":        state.Ip.String(),
+		}).Errorf("couldn't check policy: %v", err)
+		return smtp.Answer{
+			Status:       smtp.SMTPErrorTransientLocalError.Status,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "local error: something went wrong",
+		}
+	}
+
+	answer := smtp.Answer(smtpErr)
+	if answer.EnhancedCode.IsZero() {
+		answer.EnhancedCode = smtp.EnhancedCode{int(answer.Status / 100), 0, 0}
+	}
+	return answer
+}
@@ -0,0 +1,455 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/mistralmail/smtp/smtp"
+	log "github.com/sirupsen/logrus"
+)
+
+// SASLMechanism represents a SASL authentication mechanism (RFC 4422) that can be used with the AUTH command.
+type SASLMechanism interface {
+	// Name returns the name of the mechanism as advertised in the EHLO response, e.g. "PLAIN".
+	Name() string
+	// RequiresTLS returns whether the mechanism may only be used on a secure connection.
+	RequiresTLS() bool
+	// Available returns whether the backend the mechanism needs is configured on the server.
+	// Mechanisms which aren't available are neither advertised nor accepted.
+	Available(s *Server) bool
+	// Start starts a new authentication exchange for the given session.
+	Start(s *Server, state *smtp.State) SASLSession
+}
+
+// SASLSession represents a single authentication exchange of a SASLMechanism.
+type SASLSession interface {
+	// Next handles a decoded client response and returns the next challenge for the client.
+	// The response is nil when the client didn't send an initial response with the AUTH command.
+	// When done is true the exchange is finished and User returns the authenticated user,
+	// a non nil challenge is then sent to the client as additional data with success.
+	// Returns ErrInvalidCredentials if the credentials are not valid.
+	Next(response []byte) (challenge []byte, done bool, err error)
+	// User returns the authenticated user after a successful exchange.
+	User() User
+	// AuthorizationIdentity returns the identity the client requested to act as (RFC 4422 2),
+	// empty if the client wants to act as the authenticated user.
+	AuthorizationIdentity() string
+}
+
+// RegisterSASLMechanism registers a SASL mechanism for the AUTH command.
+// A previously registered mechanism with the same name is replaced.
+func (s *Server) RegisterSASLMechanism(mechanism SASLMechanism) {
+	name := strings.ToUpper(mechanism.Name())
+	if s.saslMechanisms == nil {
+		s.saslMechanisms = map[string]SASLMechanism{}
+	}
+	if _, ok := s.saslMechanisms[name]; !ok {
+		s.saslMechanismNames = append(s.saslMechanismNames, name)
+	}
+	s.saslMechanisms[name] = mechanism
+}
+
+// saslMechanismsFor returns the names of the registered mechanisms that can be used in the given state.
+func (s *Server) saslMechanismsFor(state *smtp.State) []string {
+	names := []string{}
+	for _, name := range s.saslMechanismNames {
+		mechanism := s.saslMechanisms[name]
+		if (mechanism.RequiresTLS() && !state.Secure) || !mechanism.Available(s) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// handleAuth runs the SASL exchange of an AUTH command.
+func (s *Server) handleAuth(proto smtp.Protocol, state *smtp.State, cmd smtp.AuthCmd) {
+	if s.config.DisableAuth {
+		proto.Send(smtp.Answer{
+			Status:       smtp.NotImplemented,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+			Message:      "Command not implemented",
+		})
+		return
+	}
+
+	/*
+		RFC 4954 4
+
+		After an AUTH command has been successfully completed, no more AUTH
+		commands may be issued in the same session.  After a successful AUTH
+		command completes, a server MUST reject any further AUTH commands
+		with a 503 reply.
+
+		The AUTH command is not permitted during a mail transaction.  An AUTH
+		command issued during a mail transaction MUST be rejected with a 503
+		reply.
+	*/
+	if state.Authenticated {
+		proto.Send(smtp.Answer{
+			Status:       smtp.BadSequence,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+			Message:      "Already authenticated",
+		})
+		return
+	}
+	if state.From != nil {
+		proto.Send(smtp.Answer{
+			Status:       smtp.AuthCommandNotPermittedDuringMailTransaction,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+			Message:      "AUTH not permitted during a mail transaction",
+		})
+		return
+	}
+
+	mechanism, ok := s.saslMechanisms[cmd.Mechanism]
+	if !ok || !mechanism.Available(s) {
+		proto.Send(smtp.Answer{
+			Status:       smtp.UnrecognizedAuthenticationType,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+			Message:      "Unrecognized authentication type",
+		})
+		return
+	}
+
+	// check whether the connection is secure
+	if mechanism.RequiresTLS() && !state.Secure {
+		proto.Send(smtp.Answer{
+			Status:       smtp.EncryptionRequiredForRequestedAuthenticationMechanism,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 11},
+			Message:      "Must issue a STARTTLS command first.",
+		})
+		return
+	}
+
+	var response []byte
+	if cmd.InitialResponse != "" {
+		var err error
+		response, err = decodeSASLResponse(cmd.InitialResponse)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Ip":        state.Ip.String(),
+				"SessionId": state.SessionId.String(),
+			}).Warningf("Could not decode base64: %v", err)
+
+			proto.Send(smtp.Answer{
+				Status:       smtp.MalformedAuthInput,
+				EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+				Message:      "Could not decode initial response",
+			})
+			return
+		}
+	}
+
+	var user User
+	session := mechanism.Start(s, state)
+	for {
+		challenge, done, err := session.Next(response)
+		if err == nil && done {
+			user, err = s.authorize(state, session)
+		}
+		if err != nil {
+			s.sendAuthError(proto, state, cmd.Mechanism, err)
+			return
+		}
+		if done && challenge == nil {
+			break
+		}
+
+		proto.Send(smtp.Answer{
+			Status:  smtp.EncodedString,
+			Message: base64.StdEncoding.EncodeToString(challenge),
+		})
+
+		line, err := smtp.ReadUntill('\n', smtp.MAX_AUTH_LINE, cmd.R)
+		if err != nil {
+			// I think this can only happen on a socket if it gets closed before receiving the full data.
+			log.WithFields(log.Fields{
+				"SessionId": state.SessionId.String(),
+			}).Warnln(err)
+			if err == smtp.ErrLtl {
+				_ = smtp.SkipTillNewline(cmd.R)
+				proto.Send(smtp.Answer{
+					Status:       smtp.AuthenticationExchangeLineTooLong,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 6},
+					Message:      "Authentication Exchange line is too long",
+				})
+				return
+			}
+			proto.Send(smtp.Answer{
+				Status:       smtp.MalformedAuthInput,
+				EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+				Message:      "Could not parse auth data",
+			})
+			return
+		}
+		encoded := strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r")
+
+		// RFC 4954 4: the client may cancel the exchange with a single "*".
+		if encoded == "*" {
+			proto.Send(smtp.Answer{
+				Status:       smtp.MalformedAuthInput,
+				EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+				Message:      "Authentication cancelled",
+			})
+			return
+		}
+
+		if done {
+			// The additional data with success has been acknowledged by the client.
+			break
+		}
+
+		response, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			proto.Send(smtp.Answer{
+				Status:       smtp.MalformedAuthInput,
+				EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+				Message:      "Could not decode response",
+			})
+			return
+		}
+		if response == nil {
+			response = []byte{}
+		}
+	}
+
+	// Valid auth
+
+	state.Authenticated = true
+	state.User = user
+
+	log.WithFields(log.Fields{
+		"Ip":        state.Ip.String(),
+		"SessionId": state.SessionId.String(),
+	}).Printf("valid auth for user: %s", state.User.Username())
+
+	proto.Send(smtp.Answer{
+		Status:       smtp.AuthenticationSucceeded,
+		EnhancedCode: smtp.EnhancedCode{2, 7, 0},
+		Message:      "Authentication successful",
+	})
+}
+
+// authorize checks whether the authenticated user of a finished SASL session may act as
+// the requested authorization identity and returns the user for the session.
+func (s *Server) authorize(state *smtp.State, session SASLSession) (User, error) {
+	user := session.User()
+	authorizationIdentity := session.AuthorizationIdentity()
+	if authorizationIdentity == "" || authorizationIdentity == user.Username() {
+		return user, nil
+	}
+
+	// Acting as another user is only allowed with an Authorizer.
+	if s.Authorizer == nil {
+		return nil, ErrNotAuthorized
+	}
+	authorized, err := s.Authorizer.Authorize(state, user, authorizationIdentity)
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"Ip":        state.Ip.String(),
+		"SessionId": state.SessionId.String(),
+	}).Printf("user %s authorized as: %s", user.Username(), authorized.Username())
+
+	return &AuthorizedUser{Authenticated: user, Authorized: authorized}, nil
+}
+
+// sendAuthError sends the answer for an error returned by a SASL session.
+func (s *Server) sendAuthError(proto smtp.Protocol, state *smtp.State, mechanism string, err error) {
+	state.Authenticated = false
+
+	if err == ErrInvalidCredentials {
+		log.WithFields(log.Fields{
+			"Ip":        state.Ip.String(),
+			"SessionId": state.SessionId.String(),
+		}).Printf("invalid auth with mechanism: %s", mechanism)
+
+		proto.Send(smtp.Answer{
+			Status:       smtp.AuthenticationCredentialsInvalid,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+			Message:      "Authentication credentials invalid",
+		})
+		return
+	}
+
+	if err == ErrNotAuthorized {
+		log.WithFields(log.Fields{
+			"Ip":        state.Ip.String(),
+			"SessionId": state.SessionId.String(),
+		}).Printf("authorization identity not allowed with mechanism: %s", mechanism)
+
+		proto.Send(smtp.Answer{
+			Status:       smtp.AuthenticationCredentialsInvalid,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+			Message:      "Not authorized to act as the requested user",
+		})
+		return
+	}
+
+	if smtpErr, ok := err.(smtp.SMTPError); ok {
+		proto.Send(smtp.Answer(smtpErr))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"Ip":        state.Ip.String(),
+		"SessionId": state.SessionId.String(),
+	}).Printf("authentication failed with mechanism: %s with error: %v", mechanism, err)
+
+	proto.Send(smtp.Answer{
+		Status:       smtp.TemporaryAuthenticationFailure,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Temporary authentication failure",
+	})
+}
+
+// decodeSASLResponse decodes a base64 encoded initial response.
+// A single "=" denotes an empty initial response (RFC 4954 4).
+func decodeSASLResponse(encoded string) ([]byte, error) {
+	if encoded == "=" {
+		return []byte{}, nil
+	}
+	response, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if response == nil {
+		response = []byte{}
+	}
+	return response, nil
+}
+
+// PlainMechanism implements the PLAIN SASL mechanism (RFC 4616) using the AuthBackend of the server.
+type PlainMechanism struct{}
+
+// Name returns the name of the mechanism
+func (m PlainMechanism) Name() string {
+	return "PLAIN"
+}
+
+// RequiresTLS returns true, PLAIN sends the password in clear text
+func (m PlainMechanism) RequiresTLS() bool {
+	return true
+}
+
+// Available returns whether an AuthBackend is configured
+func (m PlainMechanism) Available(s *Server) bool {
+	return s.AuthBackend != nil
+}
+
+// Start starts a new PLAIN exchange
+func (m PlainMechanism) Start(s *Server, state *smtp.State) SASLSession {
+	return &plainSession{server: s, state: state}
+}
+
+type plainSession struct {
+	server                *Server
+	state                 *smtp.State
+	authorizationIdentity string
+	user                  User
+}
+
+func (p *plainSession) Next(response []byte) ([]byte, bool, error) {
+	// No initial response, ask the client for the credentials with an empty challenge.
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	authorizationIdentity, authenticationIdentity, password, err := smtp.ParseAuthPlainResponse(response)
+	if err != nil {
+		return nil, false, smtp.SMTPError{
+			Status:       smtp.SyntaxErrorParam,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+			Message:      "Invalid response for PLAIN auth",
+		}
+	}
+
+	if p.server.AuthBackend == nil {
+		return nil, false, fmt.Errorf("AuthBackend not initialized")
+	}
+
+	user, err := p.server.AuthBackend.Login(p.state, authenticationIdentity, password)
+	if err != nil {
+		return nil, false, err
+	}
+	p.user = user
+	p.authorizationIdentity = authorizationIdentity
+	return nil, true, nil
+}
+
+func (p *plainSession) User() User {
+	return p.user
+}
+
+func (p *plainSession) AuthorizationIdentity() string {
+	return p.authorizationIdentity
+}
+
+// LoginMechanism implements the obsolete LOGIN SASL mechanism using the AuthBackend of the server.
+// The client sends the username and the password in response to two separate challenges,
+// the username may also be sent as initial response.
+type LoginMechanism struct{}
+
+// Name returns the name of the mechanism
+func (m LoginMechanism) Name() string {
+	return "LOGIN"
+}
+
+// RequiresTLS returns true, LOGIN sends the password in clear text
+func (m LoginMechanism) RequiresTLS() bool {
+	return true
+}
+
+// Available returns whether an AuthBackend is configured
+func (m LoginMechanism) Available(s *Server) bool {
+	return s.AuthBackend != nil
+}
+
+// Start starts a new LOGIN exchange
+func (m LoginMechanism) Start(s *Server, state *smtp.State) SASLSession {
+	return &loginSession{server: s, state: state}
+}
+
+type loginSession struct {
+	server      *Server
+	state       *smtp.State
+	username    string
+	gotUsername bool
+	user        User
+}
+
+func (l *loginSession) Next(response []byte) ([]byte, bool, error) {
+	if !l.gotUsername {
+		// No initial response, ask the client for the username.
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+		l.username = string(response)
+		l.gotUsername = true
+		return []byte("Password:"), false, nil
+	}
+
+	if l.server.AuthBackend == nil {
+		return nil, false, fmt.Errorf("AuthBackend not initialized")
+	}
+
+	user, err := l.server.AuthBackend.Login(l.state, l.username, string(response))
+	if err != nil {
+		return nil, false, err
+	}
+	l.user = user
+	return nil, true, nil
+}
+
+func (l *loginSession) User() User {
+	return l.user
+}
+
+// AuthorizationIdentity returns "", LOGIN has no authorization identity
+func (l *loginSession) AuthorizationIdentity() string {
+	return ""
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/mistralmail/smtp/smtp"
+)
+
+// CRAMMD5Mechanism implements the CRAM-MD5 SASL mechanism (RFC 2195).
+// The AuthBackend of the server must implement SecretAuthBackend.
+//
+// CRAM-MD5 doesn't send the password in clear text, so it doesn't require TLS.
+// It isn't registered by default.
+type CRAMMD5Mechanism struct{}
+
+// Name returns the name of the mechanism
+func (m CRAMMD5Mechanism) Name() string {
+	return "CRAM-MD5"
+}
+
+// RequiresTLS returns false
+func (m CRAMMD5Mechanism) RequiresTLS() bool {
+	return false
+}
+
+// Available returns whether the AuthBackend is a SecretAuthBackend
+func (m CRAMMD5Mechanism) Available(s *Server) bool {
+	_, ok := s.AuthBackend.(SecretAuthBackend)
+	return ok
+}
+
+// Start starts a new CRAM-MD5 exchange
+func (m CRAMMD5Mechanism) Start(s *Server, state *smtp.State) SASLSession {
+	return &cramMD5Session{server: s, state: state}
+}
+
+type cramMD5Session struct {
+	server    *Server
+	state     *smtp.State
+	challenge string
+	user      User
+}
+
+func (c *cramMD5Session) Next(response []byte) ([]byte, bool, error) {
+	if c.challenge == "" {
+		// CRAM-MD5 starts with a challenge of the server.
+		if response != nil {
+			return nil, false, smtp.SMTPError{
+				Status:       smtp.MalformedAuthInput,
+				EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+				Message:      "CRAM-MD5 doesn't allow an initial response",
+			}
+		}
+
+		/*
+			RFC 2195 2
+
+			The data encoded in the first ready response contains an
+			presumptively arbitrary string of random digits, a timestamp, and the
+			fully-qualified primary host name of the server.
+		*/
+		random, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+		if err != nil {
+			return nil, false, err
+		}
+		c.challenge = fmt.Sprintf("<%s.%d@%s>", random, time.Now().Unix(), c.server.config.Hostname)
+		return []byte(c.challenge), false, nil
+	}
+
+	// The response is the username, a space and the hex encoded HMAC-MD5 digest of the challenge.
+	i := strings.LastIndex(string(response), " ")
+	if i == -1 {
+		return nil, false, smtp.SMTPError{
+			Status:       smtp.MalformedAuthInput,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+			Message:      "Invalid response for CRAM-MD5 auth",
+		}
+	}
+	username := string(response[:i])
+	digest, err := hex.DecodeString(string(response[i+1:]))
+	if err != nil {
+		return nil, false, smtp.SMTPError{
+			Status:       smtp.MalformedAuthInput,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+			Message:      "Invalid response for CRAM-MD5 auth",
+		}
+	}
+
+	backend, ok := c.server.AuthBackend.(SecretAuthBackend)
+	if !ok {
+		return nil, false, fmt.Errorf("AuthBackend doesn't support CRAM-MD5")
+	}
+
+	user, secret, err := backend.Secret(c.state, username)
+	if err != nil {
+		return nil, false, err
+	}
+
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write([]byte(c.challenge))
+	if !hmac.Equal(mac.Sum(nil), digest) {
+		return nil, false, ErrInvalidCredentials
+	}
+
+	c.user = user
+	return nil, true, nil
+}
+
+func (c *cramMD5Session) User() User {
+	return c.user
+}
+
+// AuthorizationIdentity returns "", CRAM-MD5 has no authorization identity
+func (c *cramMD5Session) AuthorizationIdentity() string {
+	return ""
+}
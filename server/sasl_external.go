@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/mistralmail/smtp/smtp"
+)
+
+// ExternalMechanism implements the EXTERNAL SASL mechanism (RFC 4422 Appendix A)
+// which authenticates the client with its verified TLS client certificate.
+// The user is looked up with the CertificateMapper of the server.
+// It isn't registered by default.
+type ExternalMechanism struct{}
+
+// Name returns the name of the mechanism
+func (m ExternalMechanism) Name() string {
+	return "EXTERNAL"
+}
+
+// RequiresTLS returns true, the credentials are the TLS client certificate
+func (m ExternalMechanism) RequiresTLS() bool {
+	return true
+}
+
+// Available returns whether a CertificateMapper is configured
+func (m ExternalMechanism) Available(s *Server) bool {
+	return s.CertificateMapper != nil
+}
+
+// Start starts a new EXTERNAL exchange
+func (m ExternalMechanism) Start(s *Server, state *smtp.State) SASLSession {
+	return &externalSession{server: s, state: state}
+}
+
+type externalSession struct {
+	server                *Server
+	state                 *smtp.State
+	authorizationIdentity string
+	user                  User
+}
+
+func (e *externalSession) Next(response []byte) ([]byte, bool, error) {
+	// The client sends the (possibly empty) authorization identity,
+	// ask for it if there was no initial response.
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	authorizationIdentity := string(response)
+
+	if len(e.state.VerifiedChains) == 0 || len(e.state.VerifiedChains[0]) == 0 {
+		// No client certificate or it wasn't verified.
+		return nil, false, ErrInvalidCredentials
+	}
+
+	if e.server.CertificateMapper == nil {
+		return nil, false, fmt.Errorf("CertificateMapper not initialized")
+	}
+
+	user, err := e.server.CertificateMapper.MapCertificate(e.state, e.state.VerifiedChains[0])
+	if err != nil {
+		return nil, false, err
+	}
+
+	e.user = user
+	e.authorizationIdentity = authorizationIdentity
+	return nil, true, nil
+}
+
+func (e *externalSession) User() User {
+	return e.user
+}
+
+func (e *externalSession) AuthorizationIdentity() string {
+	return e.authorizationIdentity
+}
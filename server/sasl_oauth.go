@@ -0,0 +1,252 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mistralmail/smtp/smtp"
+)
+
+// OAuthBearerMechanism implements the OAUTHBEARER SASL mechanism (RFC 7628) using the TokenValidator of the server.
+// It isn't registered by default.
+type OAuthBearerMechanism struct {
+	// Scope is the optional scope returned to the client in the error challenge.
+	Scope string
+}
+
+// Name returns the name of the mechanism
+func (m OAuthBearerMechanism) Name() string {
+	return "OAUTHBEARER"
+}
+
+// RequiresTLS returns true, bearer tokens must not be sent in clear text
+func (m OAuthBearerMechanism) RequiresTLS() bool {
+	return true
+}
+
+// Available returns whether a TokenValidator is configured
+func (m OAuthBearerMechanism) Available(s *Server) bool {
+	return s.TokenValidator != nil
+}
+
+// Start starts a new OAUTHBEARER exchange
+func (m OAuthBearerMechanism) Start(s *Server, state *smtp.State) SASLSession {
+	return &oauthSession{
+		server:       s,
+		state:        state,
+		parse:        parseOAuthBearerResponse,
+		errorStatus:  "invalid_token",
+		errorSchemes: "bearer",
+		errorScope:   m.Scope,
+	}
+}
+
+// XOAuth2Mechanism implements the XOAUTH2 SASL mechanism using the TokenValidator of the server.
+// It isn't registered by default.
+type XOAuth2Mechanism struct {
+	// Scope is the optional scope returned to the client in the error challenge.
+	Scope string
+}
+
+// Name returns the name of the mechanism
+func (m XOAuth2Mechanism) Name() string {
+	return "XOAUTH2"
+}
+
+// RequiresTLS returns true, bearer tokens must not be sent in clear text
+func (m XOAuth2Mechanism) RequiresTLS() bool {
+	return true
+}
+
+// Available returns whether a TokenValidator is configured
+func (m XOAuth2Mechanism) Available(s *Server) bool {
+	return s.TokenValidator != nil
+}
+
+// Start starts a new XOAUTH2 exchange
+func (m XOAuth2Mechanism) Start(s *Server, state *smtp.State) SASLSession {
+	return &oauthSession{
+		server:       s,
+		state:        state,
+		parse:        parseXOAuth2Response,
+		errorStatus:  "401",
+		errorSchemes: "Bearer",
+		errorScope:   m.Scope,
+	}
+}
+
+// oauthError is the JSON error challenge sent when the token is not valid (RFC 7628 3.2.2).
+type oauthError struct {
+	Status  string `json:"status"`
+	Schemes string `json:"schemes,omitempty"`
+	Scope   string `json:"scope,omitempty"`
+}
+
+type oauthSession struct {
+	server *Server
+	state  *smtp.State
+	parse  func(response []byte) (username string, authorizationIdentity string, token string, err error)
+
+	errorStatus  string
+	errorSchemes string
+	errorScope   string
+
+	// failed is set when the error challenge was sent to the client.
+	failed                bool
+	authorizationIdentity string
+	user                  User
+}
+
+func (o *oauthSession) Next(response []byte) ([]byte, bool, error) {
+	// After the error challenge the client sends a dummy response
+	// and the server fails the authentication (RFC 7628 3.2.2).
+	if o.failed {
+		return nil, false, ErrInvalidCredentials
+	}
+
+	// Both mechanisms are client-first, ask for the token if there was no initial response.
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	username, authorizationIdentity, token, err := o.parse(response)
+	if err != nil {
+		return nil, false, smtp.SMTPError{
+			Status:       smtp.MalformedAuthInput,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+			Message:      err.Error(),
+		}
+	}
+
+	if o.server.TokenValidator == nil {
+		return nil, false, fmt.Errorf("TokenValidator not initialized")
+	}
+
+	user, err := o.server.TokenValidator.ValidateToken(o.state, username, token)
+	if err == ErrInvalidCredentials {
+		o.failed = true
+		challenge, err := json.Marshal(oauthError{
+			Status:  o.errorStatus,
+			Schemes: o.errorSchemes,
+			Scope:   o.errorScope,
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		return challenge, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	o.user = user
+	o.authorizationIdentity = authorizationIdentity
+	return nil, true, nil
+}
+
+func (o *oauthSession) User() User {
+	return o.user
+}
+
+func (o *oauthSession) AuthorizationIdentity() string {
+	return o.authorizationIdentity
+}
+
+// parseOAuthBearerResponse parses the initial client response of OAUTHBEARER.
+// The authorization identity is also passed as username to the TokenValidator.
+func parseOAuthBearerResponse(response []byte) (string, string, string, error) {
+	/*
+		RFC 7628 3.1
+
+		kvsep          = %x01
+		key            = 1*(ALPHA)
+		value          = *(VCHAR / SP / HTAB / CR / LF )
+		kvpair         = key "=" value kvsep
+		client-resp    = (gs2-header kvsep *kvpair kvsep) / kvsep
+	*/
+	message := string(response)
+	i := strings.Index(message, "\x01")
+	if i == -1 {
+		return "", "", "", fmt.Errorf("Invalid response for OAUTHBEARER auth")
+	}
+	gs2Header, pairs := message[:i], message[i+1:]
+
+	// gs2-header = gs2-cbind-flag "," [ authzid ] ","
+	parts := strings.Split(gs2Header, ",")
+	if len(parts) != 3 || parts[2] != "" || (parts[0] != "n" && parts[0] != "y") {
+		return "", "", "", fmt.Errorf("Invalid GS2 header for OAUTHBEARER auth")
+	}
+	username := ""
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return "", "", "", fmt.Errorf("Invalid GS2 header for OAUTHBEARER auth")
+		}
+		var err error
+		username, err = decodeSASLName(parts[1][2:])
+		if err != nil {
+			return "", "", "", fmt.Errorf("Invalid GS2 header for OAUTHBEARER auth")
+		}
+	}
+
+	token, err := parseOAuthPairs(pairs)
+	if err != nil {
+		return "", "", "", err
+	}
+	return username, username, token, nil
+}
+
+// parseXOAuth2Response parses the initial client response of XOAUTH2:
+// "user=" username %x01 "auth=Bearer " token %x01 %x01
+func parseXOAuth2Response(response []byte) (string, string, string, error) {
+	message := string(response)
+	if !strings.HasPrefix(message, "user=") {
+		return "", "", "", fmt.Errorf("Invalid response for XOAUTH2 auth")
+	}
+	i := strings.Index(message, "\x01")
+	if i == -1 {
+		return "", "", "", fmt.Errorf("Invalid response for XOAUTH2 auth")
+	}
+
+	token, err := parseOAuthPairs(message[i+1:])
+	if err != nil {
+		return "", "", "", err
+	}
+	return message[len("user="):i], "", token, nil
+}
+
+// parseOAuthPairs returns the bearer token of the auth key in a list of %x01 separated
+// key/value pairs which is terminated by an extra %x01.
+func parseOAuthPairs(pairs string) (string, error) {
+	if !strings.HasSuffix(pairs, "\x01") {
+		return "", fmt.Errorf("Invalid key/value pairs in OAuth response")
+	}
+
+	token := ""
+	pairs = strings.TrimSuffix(pairs, "\x01")
+	for pairs != "" {
+		pair, rest, ok := strings.Cut(pairs, "\x01")
+		if !ok {
+			return "", fmt.Errorf("Invalid key/value pairs in OAuth response")
+		}
+		pairs = rest
+
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return "", fmt.Errorf("Invalid key/value pairs in OAuth response")
+		}
+		if key != "auth" {
+			continue
+		}
+		scheme, credentials, ok := strings.Cut(value, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || credentials == "" {
+			return "", fmt.Errorf("Invalid bearer token in OAuth response")
+		}
+		token = credentials
+	}
+
+	if token == "" {
+		return "", fmt.Errorf("No bearer token in OAuth response")
+	}
+	return token, nil
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/mistralmail/smtp/smtp"
+)
+
+// SCRAMSHA256Mechanism implements the SCRAM-SHA-256 and SCRAM-SHA-256-PLUS SASL mechanisms (RFC 5802, RFC 7677).
+// The AuthBackend of the server must implement SCRAMAuthBackend.
+//
+// The PLUS variant binds the exchange to the TLS session with the tls-unique (RFC 5929)
+// or tls-exporter (RFC 9266) channel binding and can only be used over TLS.
+// SCRAM-SHA-256 doesn't send the password in clear text, so it doesn't require TLS.
+// Neither variant is registered by default.
+type SCRAMSHA256Mechanism struct {
+	Plus bool
+}
+
+// Name returns the name of the mechanism
+func (m SCRAMSHA256Mechanism) Name() string {
+	if m.Plus {
+		return "SCRAM-SHA-256-PLUS"
+	}
+	return "SCRAM-SHA-256"
+}
+
+// RequiresTLS returns true for the PLUS variant which needs the TLS channel binding
+func (m SCRAMSHA256Mechanism) RequiresTLS() bool {
+	return m.Plus
+}
+
+// Available returns whether the AuthBackend is a SCRAMAuthBackend
+func (m SCRAMSHA256Mechanism) Available(s *Server) bool {
+	_, ok := s.AuthBackend.(SCRAMAuthBackend)
+	return ok
+}
+
+// Start starts a new SCRAM exchange
+func (m SCRAMSHA256Mechanism) Start(s *Server, state *smtp.State) SASLSession {
+	return &scramSession{server: s, state: state, plus: m.Plus}
+}
+
+type scramSession struct {
+	server *Server
+	state  *smtp.State
+	plus   bool
+
+	step                   int
+	gs2Header              string
+	channelBinding         []byte
+	nonce                  string
+	clientFirstMessageBare string
+	serverFirstMessage     string
+	credentials            SCRAMCredentials
+	authorizationIdentity  string
+	user                   User
+}
+
+// errSCRAMMalformed is returned for a malformed SCRAM message
+var errSCRAMMalformed = smtp.SMTPError{
+	Status:       smtp.MalformedAuthInput,
+	EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+	Message:      "Invalid response for SCRAM auth",
+}
+
+func (s *scramSession) Next(response []byte) ([]byte, bool, error) {
+	s.step++
+	switch s.step {
+	case 1:
+		// SCRAM is client-first, ask for the client-first-message if there was no initial response.
+		if response == nil {
+			s.step = 0
+			return []byte{}, false, nil
+		}
+		return s.handleClientFirst(string(response))
+	case 2:
+		return s.handleClientFinal(string(response))
+	default:
+		return nil, false, errSCRAMMalformed
+	}
+}
+
+func (s *scramSession) User() User {
+	return s.user
+}
+
+func (s *scramSession) AuthorizationIdentity() string {
+	return s.authorizationIdentity
+}
+
+// handleClientFirst handles the client-first-message and returns the server-first-message.
+func (s *scramSession) handleClientFirst(message string) ([]byte, bool, error) {
+	/*
+		RFC 5802 7
+
+		client-first-message = gs2-header client-first-message-bare
+		gs2-header      = gs2-cbind-flag "," [ authzid ] ","
+		gs2-cbind-flag  = ("p=" cb-name) / "n" / "y"
+		client-first-message-bare = [reserved-mext ","] username "," nonce ["," extensions]
+	*/
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return nil, false, errSCRAMMalformed
+	}
+	cbindFlag, authzid, bare := parts[0], parts[1], parts[2]
+	s.gs2Header = cbindFlag + "," + authzid + ","
+	s.clientFirstMessageBare = bare
+
+	if err := s.checkChannelBinding(cbindFlag); err != nil {
+		return nil, false, err
+	}
+
+	if authzid != "" {
+		if !strings.HasPrefix(authzid, "a=") {
+			return nil, false, errSCRAMMalformed
+		}
+		name, err := decodeSASLName(authzid[2:])
+		if err != nil {
+			return nil, false, errSCRAMMalformed
+		}
+		s.authorizationIdentity = name
+	}
+
+	attributes := strings.Split(bare, ",")
+	if len(attributes) < 2 || !strings.HasPrefix(attributes[0], "n=") || !strings.HasPrefix(attributes[1], "r=") || len(attributes[1]) == 2 {
+		return nil, false, errSCRAMMalformed
+	}
+	username, err := decodeSASLName(attributes[0][2:])
+	if err != nil {
+		return nil, false, errSCRAMMalformed
+	}
+
+	backend, ok := s.server.AuthBackend.(SCRAMAuthBackend)
+	if !ok {
+		return nil, false, fmt.Errorf("AuthBackend doesn't support SCRAM")
+	}
+	user, credentials, err := backend.SCRAMCredentials(s.state, username)
+	if err != nil {
+		return nil, false, err
+	}
+	s.user = user
+	s.credentials = credentials
+
+	serverNonce := make([]byte, 18)
+	_, err = rand.Read(serverNonce)
+	if err != nil {
+		return nil, false, err
+	}
+	s.nonce = attributes[1][2:] + base64.StdEncoding.EncodeToString(serverNonce)
+
+	s.serverFirstMessage = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce, base64.StdEncoding.EncodeToString(credentials.Salt), credentials.Iterations)
+	return []byte(s.serverFirstMessage), false, nil
+}
+
+// checkChannelBinding checks the gs2-cbind-flag and gets the channel binding data of the TLS session.
+func (s *scramSession) checkChannelBinding(cbindFlag string) error {
+	if !s.plus {
+		switch cbindFlag {
+		case "n":
+			return nil
+		case "y":
+			/*
+				RFC 5802 6
+
+				If the flag is set to "y" and the server supports channel
+				binding, the server MUST fail authentication.  This is because
+				if the client sets the channel binding flag to "y", then the
+				client must have believed that the server did not support
+				channel binding -- if the server did in fact support channel
+				binding, then this is an indication that there has been a
+				downgrade attack
+			*/
+			if _, ok := s.server.saslMechanisms["SCRAM-SHA-256-PLUS"]; ok && s.state.TLSState != nil {
+				return ErrInvalidCredentials
+			}
+			return nil
+		default:
+			return smtp.SMTPError{
+				Status:       smtp.MalformedAuthInput,
+				EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+				Message:      "Channel binding requires SCRAM-SHA-256-PLUS",
+			}
+		}
+	}
+
+	if s.state.TLSState == nil {
+		return fmt.Errorf("no TLS connection state for channel binding")
+	}
+
+	var err error
+	switch cbindFlag {
+	case "p=tls-unique":
+		s.channelBinding = s.state.TLSState.TLSUnique
+		if len(s.channelBinding) == 0 {
+			err = fmt.Errorf("tls-unique not available")
+		}
+	case "p=tls-exporter":
+		s.channelBinding, err = s.state.TLSState.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	default:
+		return smtp.SMTPError{
+			Status:       smtp.MalformedAuthInput,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+			Message:      "Unsupported channel binding type",
+		}
+	}
+	if err != nil {
+		return smtp.SMTPError{
+			Status:       smtp.MalformedAuthInput,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+			Message:      fmt.Sprintf("Channel binding not available: %v", err),
+		}
+	}
+	return nil
+}
+
+// handleClientFinal handles the client-final-message and returns the server-final-message.
+func (s *scramSession) handleClientFinal(message string) ([]byte, bool, error) {
+	/*
+		RFC 5802 7
+
+		client-final-message-without-proof = channel-binding "," nonce ["," extensions]
+		client-final-message = client-final-message-without-proof "," proof
+	*/
+	i := strings.LastIndex(message, ",p=")
+	if i == -1 {
+		return nil, false, errSCRAMMalformed
+	}
+	withoutProof := message[:i]
+	proof, err := base64.StdEncoding.DecodeString(message[i+3:])
+	if err != nil {
+		return nil, false, errSCRAMMalformed
+	}
+
+	attributes := strings.Split(withoutProof, ",")
+	if len(attributes) < 2 || !strings.HasPrefix(attributes[0], "c=") || !strings.HasPrefix(attributes[1], "r=") {
+		return nil, false, errSCRAMMalformed
+	}
+	cbind, err := base64.StdEncoding.DecodeString(attributes[0][2:])
+	if err != nil {
+		return nil, false, errSCRAMMalformed
+	}
+	expectedCbind := append([]byte(s.gs2Header), s.channelBinding...)
+	if !hmac.Equal(cbind, expectedCbind) || attributes[1][2:] != s.nonce {
+		return nil, false, ErrInvalidCredentials
+	}
+
+	authMessage := []byte(s.clientFirstMessageBare + "," + s.serverFirstMessage + "," + withoutProof)
+
+	// ClientKey := ClientProof XOR ClientSignature and StoredKey must equal H(ClientKey)
+	clientSignature := scramHMAC(s.credentials.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, false, ErrInvalidCredentials
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], s.credentials.StoredKey) {
+		return nil, false, ErrInvalidCredentials
+	}
+
+	serverSignature := scramHMAC(s.credentials.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), true, nil
+}
+
+// decodeSASLName decodes a saslname where "," and "=" are encoded as "=2C" and "=3D".
+func decodeSASLName(name string) (string, error) {
+	var buf bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			buf.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			buf.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			buf.WriteByte('=')
+		default:
+			return "", fmt.Errorf("invalid encoding in saslname: %q", name)
+		}
+		i += 2
+	}
+	return buf.String(), nil
+}
+
+// scramHMAC returns HMAC-SHA-256 of data with key.
+func scramHMAC(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// scramHi is the Hi function of RFC 5802 2.2, which is PBKDF2 with HMAC-SHA-256
+// and an output length of one block.
+func scramHi(password []byte, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
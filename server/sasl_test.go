@@ -0,0 +1,883 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/mistralmail/smtp/smtp"
+	c "github.com/smartystreets/goconvey/convey"
+)
+
+// testMechanism asks for a username and a password in two separate challenges.
+type testMechanism struct {
+	err error
+}
+
+func (m testMechanism) Name() string {
+	return "X-TEST"
+}
+
+func (m testMechanism) RequiresTLS() bool {
+	return false
+}
+
+func (m testMechanism) Available(s *Server) bool {
+	return true
+}
+
+func (m testMechanism) Start(s *Server, state *smtp.State) SASLSession {
+	return &testSession{err: m.err}
+}
+
+type testSession struct {
+	err      error
+	step     int
+	username string
+}
+
+func (t *testSession) Next(response []byte) ([]byte, bool, error) {
+	t.step++
+	switch t.step {
+	case 1:
+		return []byte("Username"), false, nil
+	case 2:
+		t.username = string(response)
+		return []byte("Password"), false, nil
+	default:
+		if t.err != nil {
+			return nil, false, t.err
+		}
+		if string(response) != "secret" {
+			return nil, false, ErrInvalidCredentials
+		}
+		return []byte("Welcome"), true, nil
+	}
+}
+
+func (t *testSession) User() User {
+	return &SMTPUser{username: t.username}
+}
+
+func (t *testSession) AuthorizationIdentity() string {
+	return ""
+}
+
+func TestSASL(t *testing.T) {
+	cfg := Config{
+		Hostname: "home.sweet.home",
+	}
+
+	mta := New(cfg, HandlerFunc(dummyHandler))
+	if mta == nil {
+		t.Fatal("Could not create mta server")
+	}
+	mta.RegisterSASLMechanism(testMechanism{})
+
+	// "bob", "secret" and an empty response base64 encoded
+	responses := "Ym9i\r\nc2VjcmV0\r\n\r\n"
+
+	auth := func(responses string, answers ...smtp.Answer) *testProtocol {
+		proto := &testProtocol{
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.AuthCmd{
+					Mechanism: "X-TEST",
+					R:         bufio.NewReader(bytes.NewReader([]byte(responses))),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status: smtp.Ready,
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+			},
+		}
+		for _, answer := range answers {
+			proto.answers = append(proto.answers, answer)
+		}
+		proto.answers = append(proto.answers, smtp.Answer{
+			Status: smtp.Closing,
+		})
+		return proto
+	}
+
+	c.Convey("Testing registered SASL mechanisms", t, func() {
+		state := &smtp.State{}
+		c.So(mta.saslMechanismsFor(state), c.ShouldResemble, []string{"X-TEST"})
+
+		// PLAIN and LOGIN need an AuthBackend.
+		state.Secure = true
+		c.So(mta.saslMechanismsFor(state), c.ShouldResemble, []string{"X-TEST"})
+
+		mta.AuthBackend = NewAuthBackendMemory(map[string]string{})
+		defer func() {
+			mta.AuthBackend = nil
+		}()
+		c.So(mta.saslMechanismsFor(state), c.ShouldResemble, []string{"PLAIN", "LOGIN", "X-TEST"})
+	})
+
+	c.Convey("Testing AUTH advertised in EHLO", t, func(ctx c.C) {
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status: smtp.Ready,
+				},
+				smtp.MultiAnswer{
+					Status:   smtp.Ok,
+					Messages: []string{cfg.Hostname, "8BITMIME", "PIPELINING", "CHUNKING", "BINARYMIME", "SMTPUTF8", "DSN", "ENHANCEDSTATUSCODES", "SIZE", "DELIVERBY", "MT-PRIORITY", "AUTH X-TEST", "OK"},
+				},
+				smtp.Answer{
+					Status: smtp.Closing,
+				},
+			},
+		}
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing multi-step AUTH exchange", t, func(ctx c.C) {
+		proto := auth(responses,
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.AuthenticationSucceeded, EnhancedCode: smtp.EnhancedCode{2, 7, 0}},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeTrue)
+		c.So(proto.GetState().User.Username(), c.ShouldEqual, "bob")
+	})
+
+	c.Convey("Testing AUTH exchange with invalid credentials", t, func(ctx c.C) {
+		proto := auth("Ym9i\r\ncGFzc3dvcmQ=\r\n",
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.AuthenticationCredentialsInvalid, EnhancedCode: smtp.EnhancedCode{5, 7, 8}},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeFalse)
+	})
+
+	c.Convey("Testing cancelled AUTH exchange", t, func(ctx c.C) {
+		proto := auth("Ym9i\r\n*\r\n",
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.MalformedAuthInput},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeFalse)
+	})
+
+	c.Convey("Testing AUTH exchange with invalid base64", t, func(ctx c.C) {
+		proto := auth("Ym9i\r\nnot base64\r\n",
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.MalformedAuthInput, EnhancedCode: smtp.EnhancedCode{5, 5, 2}},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeFalse)
+	})
+
+	c.Convey("Testing AUTH exchange with temporary failure", t, func(ctx c.C) {
+		mta := New(cfg, HandlerFunc(dummyHandler))
+		mta.RegisterSASLMechanism(testMechanism{err: errors.New("backend down")})
+
+		proto := auth(responses,
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.TemporaryAuthenticationFailure, EnhancedCode: smtp.EnhancedCode{4, 7, 0}},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeFalse)
+	})
+
+	c.Convey("Testing AUTH when already authenticated", t, func(ctx c.C) {
+		proto := auth(responses,
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.AuthenticationSucceeded},
+			smtp.Answer{Status: smtp.BadSequence, EnhancedCode: smtp.EnhancedCode{5, 5, 1}},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		// send the AUTH command a second time
+		proto.cmds = []smtp.Cmd{proto.cmds[0], proto.cmds[1], proto.cmds[1], proto.cmds[2]}
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeTrue)
+	})
+}
+
+func TestLoginMechanism(t *testing.T) {
+	cfg := Config{
+		Hostname: "home.sweet.home",
+	}
+
+	mta := New(cfg, HandlerFunc(dummyHandler))
+	if mta == nil {
+		t.Fatal("Could not create mta server")
+	}
+	mta.TlsConfig = &tls.Config{}
+	mta.AuthBackend = NewAuthBackendMemory(map[string]string{"some-username@example.com": "password1234"})
+
+	login := func(initialResponse string, responses string, answers ...smtp.Answer) *testProtocol {
+		proto := &testProtocol{
+			expectTLS: true,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.StartTlsCmd{},
+				smtp.AuthCmd{
+					Mechanism:       "LOGIN",
+					InitialResponse: initialResponse,
+					R:               bufio.NewReader(bytes.NewReader([]byte(responses))),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status: smtp.Ready,
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ready,
+				},
+			},
+		}
+		for _, answer := range answers {
+			proto.answers = append(proto.answers, answer)
+		}
+		proto.answers = append(proto.answers, smtp.Answer{
+			Status: smtp.Closing,
+		})
+		return proto
+	}
+
+	c.Convey("Testing LOGIN challenges", t, func() {
+		session := LoginMechanism{}.Start(mta, &smtp.State{})
+
+		challenge, done, err := session.Next(nil)
+		c.So(err, c.ShouldBeNil)
+		c.So(done, c.ShouldBeFalse)
+		c.So(string(challenge), c.ShouldEqual, "Username:")
+
+		challenge, done, err = session.Next([]byte("some-username@example.com"))
+		c.So(err, c.ShouldBeNil)
+		c.So(done, c.ShouldBeFalse)
+		c.So(string(challenge), c.ShouldEqual, "Password:")
+
+		challenge, done, err = session.Next([]byte("password1234"))
+		c.So(err, c.ShouldBeNil)
+		c.So(done, c.ShouldBeTrue)
+		c.So(challenge, c.ShouldBeNil)
+		c.So(session.User().Username(), c.ShouldEqual, "some-username@example.com")
+	})
+
+	c.Convey("Testing AUTH LOGIN with prompted username", t, func(ctx c.C) {
+		proto := login("", "c29tZS11c2VybmFtZUBleGFtcGxlLmNvbQ==\r\ncGFzc3dvcmQxMjM0\r\n",
+			smtp.Answer{Status: smtp.EncodedString, Message: "VXNlcm5hbWU6"},
+			smtp.Answer{Status: smtp.EncodedString, Message: "UGFzc3dvcmQ6"},
+			smtp.Answer{Status: smtp.AuthenticationSucceeded},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeTrue)
+		c.So(proto.GetState().User.Username(), c.ShouldEqual, "some-username@example.com")
+	})
+
+	c.Convey("Testing AUTH LOGIN with initial response", t, func(ctx c.C) {
+		proto := login("c29tZS11c2VybmFtZUBleGFtcGxlLmNvbQ==", "cGFzc3dvcmQxMjM0\r\n",
+			smtp.Answer{Status: smtp.EncodedString, Message: "UGFzc3dvcmQ6"},
+			smtp.Answer{Status: smtp.AuthenticationSucceeded},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeTrue)
+	})
+
+	c.Convey("Testing AUTH LOGIN with incorrect password", t, func(ctx c.C) {
+		proto := login("c29tZS11c2VybmFtZUBleGFtcGxlLmNvbQ==", "d3Jvbmc=\r\n",
+			smtp.Answer{Status: smtp.EncodedString, Message: "UGFzc3dvcmQ6"},
+			smtp.Answer{Status: smtp.AuthenticationCredentialsInvalid},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeFalse)
+	})
+}
+
+// scramBackend returns the SCRAM credentials of the RFC 7677 example.
+type scramBackend struct {
+	AuthBackendMemory
+}
+
+func (b *scramBackend) SCRAMCredentials(state *smtp.State, username string) (User, SCRAMCredentials, error) {
+	if username != "user" {
+		return nil, SCRAMCredentials{}, ErrInvalidCredentials
+	}
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	return &SMTPUser{username: username}, NewSCRAMCredentials("pencil", salt, 4096), nil
+}
+
+func TestCRAMMD5Mechanism(t *testing.T) {
+	mta := New(Config{Hostname: "home.sweet.home"}, HandlerFunc(dummyHandler))
+	mta.AuthBackend = NewAuthBackendMemory(map[string]string{"tim": "tanstaaftanstaaf"})
+	mta.RegisterSASLMechanism(CRAMMD5Mechanism{})
+
+	c.Convey("Testing CRAM-MD5 is advertised without TLS", t, func() {
+		c.So(mta.saslMechanismsFor(&smtp.State{}), c.ShouldResemble, []string{"CRAM-MD5"})
+	})
+
+	c.Convey("Testing CRAM-MD5 exchange", t, func() {
+		session := CRAMMD5Mechanism{}.Start(mta, &smtp.State{})
+
+		challenge, done, err := session.Next(nil)
+		c.So(err, c.ShouldBeNil)
+		c.So(done, c.ShouldBeFalse)
+		c.So(string(challenge), c.ShouldStartWith, "<")
+		c.So(string(challenge), c.ShouldEndWith, "@home.sweet.home>")
+
+		// Use the challenge of the example in RFC 2195
+		session.(*cramMD5Session).challenge = "<1896.697170952@postoffice.reston.mci.net>"
+		challenge, done, err = session.Next([]byte("tim b913a602c7eda7a495b4e6e7334d3890"))
+		c.So(err, c.ShouldBeNil)
+		c.So(done, c.ShouldBeTrue)
+		c.So(challenge, c.ShouldBeNil)
+		c.So(session.User().Username(), c.ShouldEqual, "tim")
+	})
+
+	c.Convey("Testing CRAM-MD5 with invalid responses", t, func() {
+		session := CRAMMD5Mechanism{}.Start(mta, &smtp.State{})
+		_, _, err := session.Next([]byte("initial response"))
+		c.So(err, c.ShouldHaveSameTypeAs, smtp.SMTPError{})
+
+		session = CRAMMD5Mechanism{}.Start(mta, &smtp.State{})
+		_, _, err = session.Next(nil)
+		c.So(err, c.ShouldBeNil)
+		_, _, err = session.Next([]byte("tim b913a602c7eda7a495b4e6e7334d3890"))
+		c.So(err, c.ShouldEqual, ErrInvalidCredentials)
+
+		session = CRAMMD5Mechanism{}.Start(mta, &smtp.State{})
+		_, _, err = session.Next(nil)
+		c.So(err, c.ShouldBeNil)
+		_, _, err = session.Next([]byte("tim"))
+		c.So(err, c.ShouldHaveSameTypeAs, smtp.SMTPError{})
+	})
+}
+
+func TestSCRAMSHA256Mechanism(t *testing.T) {
+	mta := New(Config{Hostname: "home.sweet.home"}, HandlerFunc(dummyHandler))
+	mta.AuthBackend = &scramBackend{}
+	mta.RegisterSASLMechanism(SCRAMSHA256Mechanism{})
+	mta.RegisterSASLMechanism(SCRAMSHA256Mechanism{Plus: true})
+
+	c.Convey("Testing SCRAM-SHA-256-PLUS is only advertised with TLS", t, func() {
+		c.So(mta.saslMechanismsFor(&smtp.State{}), c.ShouldResemble, []string{"SCRAM-SHA-256"})
+		c.So(mta.saslMechanismsFor(&smtp.State{Secure: true}), c.ShouldResemble, []string{"PLAIN", "LOGIN", "SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"})
+	})
+
+	// The example of RFC 7677 3
+	c.Convey("Testing SCRAM-SHA-256 exchange", t, func() {
+		session := SCRAMSHA256Mechanism{}.Start(mta, &smtp.State{})
+
+		challenge, done, err := session.Next(nil)
+		c.So(err, c.ShouldBeNil)
+		c.So(done, c.ShouldBeFalse)
+		c.So(challenge, c.ShouldBeEmpty)
+
+		challenge, done, err = session.Next([]byte("n,,n=user,r=rOprNGfwEbeRWgbNEkqO"))
+		c.So(err, c.ShouldBeNil)
+		c.So(done, c.ShouldBeFalse)
+		c.So(string(challenge), c.ShouldStartWith, "r=rOprNGfwEbeRWgbNEkqO")
+		c.So(string(challenge), c.ShouldEndWith, ",s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+
+		// Use the server nonce of the example
+		session.(*scramSession).nonce = "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+		session.(*scramSession).serverFirstMessage = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+
+		challenge, done, err = session.Next([]byte("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+		c.So(err, c.ShouldBeNil)
+		c.So(done, c.ShouldBeTrue)
+		c.So(string(challenge), c.ShouldEqual, "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")
+		c.So(session.User().Username(), c.ShouldEqual, "user")
+	})
+
+	c.Convey("Testing SCRAM-SHA-256 with invalid proof", t, func() {
+		session := SCRAMSHA256Mechanism{}.Start(mta, &smtp.State{})
+		_, _, err := session.Next([]byte("n,,n=user,r=rOprNGfwEbeRWgbNEkqO"))
+		c.So(err, c.ShouldBeNil)
+		session.(*scramSession).nonce = "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+		session.(*scramSession).serverFirstMessage = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+
+		_, _, err = session.Next([]byte("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=AHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+		c.So(err, c.ShouldEqual, ErrInvalidCredentials)
+	})
+
+	c.Convey("Testing SCRAM-SHA-256 with invalid messages", t, func() {
+		for _, message := range []string{"n,n=user,r=abc", "n,,r=abc,n=user", "n,,n=user,r=", "p=tls-unique,,n=user,r=abc", "n,,n=us=er,r=abc"} {
+			session := SCRAMSHA256Mechanism{}.Start(mta, &smtp.State{})
+			_, _, err := session.Next([]byte(message))
+			c.So(err, c.ShouldHaveSameTypeAs, smtp.SMTPError{})
+		}
+
+		session := SCRAMSHA256Mechanism{}.Start(mta, &smtp.State{})
+		_, _, err := session.Next([]byte("n,,n=unknown,r=abc"))
+		c.So(err, c.ShouldEqual, ErrInvalidCredentials)
+	})
+
+	c.Convey("Testing SCRAM-SHA-256 downgrade detection", t, func() {
+		state := &smtp.State{Secure: true, TLSState: &tls.ConnectionState{TLSUnique: []byte("unique")}}
+		session := SCRAMSHA256Mechanism{}.Start(mta, state)
+		_, _, err := session.Next([]byte("y,,n=user,r=abc"))
+		c.So(err, c.ShouldEqual, ErrInvalidCredentials)
+
+		session = SCRAMSHA256Mechanism{}.Start(mta, &smtp.State{})
+		_, _, err = session.Next([]byte("y,,n=user,r=abc"))
+		c.So(err, c.ShouldBeNil)
+	})
+
+	c.Convey("Testing SCRAM-SHA-256-PLUS with tls-unique channel binding", t, func() {
+		state := &smtp.State{Secure: true, TLSState: &tls.ConnectionState{TLSUnique: []byte("unique")}}
+		session := SCRAMSHA256Mechanism{Plus: true}.Start(mta, state)
+		_, _, err := session.Next([]byte("p=tls-unique,,n=user,r=rOprNGfwEbeRWgbNEkqO"))
+		c.So(err, c.ShouldBeNil)
+
+		// The client proof is calculated over the gs2 header and the channel binding data.
+		scram := session.(*scramSession)
+		cbind := base64.StdEncoding.EncodeToString([]byte("p=tls-unique,,unique"))
+		withoutProof := "c=" + cbind + ",r=" + scram.nonce
+		authMessage := []byte(scram.clientFirstMessageBare + "," + scram.serverFirstMessage + "," + withoutProof)
+		salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+		clientKey := scramHMAC(scramHi([]byte("pencil"), salt, 4096), []byte("Client Key"))
+		clientSignature := scramHMAC(scram.credentials.StoredKey, authMessage)
+		for i := range clientKey {
+			clientKey[i] ^= clientSignature[i]
+		}
+		proof := base64.StdEncoding.EncodeToString(clientKey)
+
+		_, _, err = session.Next([]byte("c=biws,r=" + scram.nonce + ",p=" + proof))
+		c.So(err, c.ShouldEqual, ErrInvalidCredentials)
+
+		session = SCRAMSHA256Mechanism{Plus: true}.Start(mta, state)
+		_, _, err = session.Next([]byte("p=tls-unique,,n=user,r=rOprNGfwEbeRWgbNEkqO"))
+		c.So(err, c.ShouldBeNil)
+		session.(*scramSession).nonce = scram.nonce
+		session.(*scramSession).serverFirstMessage = scram.serverFirstMessage
+		_, done, err := session.Next([]byte(withoutProof + ",p=" + proof))
+		c.So(err, c.ShouldBeNil)
+		c.So(done, c.ShouldBeTrue)
+
+		session = SCRAMSHA256Mechanism{Plus: true}.Start(mta, state)
+		_, _, err = session.Next([]byte("n,,n=user,r=rOprNGfwEbeRWgbNEkqO"))
+		c.So(err, c.ShouldHaveSameTypeAs, smtp.SMTPError{})
+	})
+}
+
+// testTokenValidator accepts the token "valid-token" for every user.
+type testTokenValidator struct{}
+
+func (v testTokenValidator) ValidateToken(state *smtp.State, username string, token string) (User, error) {
+	if token != "valid-token" {
+		return nil, ErrInvalidCredentials
+	}
+	if username == "" {
+		username = "token-owner@example.com"
+	}
+	return &SMTPUser{username: username}, nil
+}
+
+func TestOAuthMechanisms(t *testing.T) {
+	cfg := Config{
+		Hostname: "home.sweet.home",
+	}
+
+	mta := New(cfg, HandlerFunc(dummyHandler))
+	if mta == nil {
+		t.Fatal("Could not create mta server")
+	}
+	mta.TlsConfig = &tls.Config{}
+	mta.TokenValidator = testTokenValidator{}
+	mta.RegisterSASLMechanism(OAuthBearerMechanism{Scope: "mail"})
+	mta.RegisterSASLMechanism(XOAuth2Mechanism{})
+
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	oauth := func(mechanism string, initialResponse string, responses string, answers ...interface{}) *testProtocol {
+		proto := &testProtocol{
+			expectTLS: true,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.StartTlsCmd{},
+				smtp.AuthCmd{
+					Mechanism:       mechanism,
+					InitialResponse: initialResponse,
+					R:               bufio.NewReader(bytes.NewReader([]byte(responses))),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status: smtp.Ready,
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ready,
+				},
+			},
+		}
+		proto.answers = append(proto.answers, answers...)
+		proto.answers = append(proto.answers, smtp.Answer{
+			Status: smtp.Closing,
+		})
+		return proto
+	}
+
+	c.Convey("Testing OAUTHBEARER with a valid token", t, func(ctx c.C) {
+		proto := oauth("OAUTHBEARER", encode("n,a=user@example.com,\x01host=home.sweet.home\x01port=587\x01auth=Bearer valid-token\x01\x01"), "",
+			smtp.Answer{Status: smtp.AuthenticationSucceeded},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		proto.cmds = append(proto.cmds[:3], smtp.MailCmd{From: getMailWithoutError("user@example.com")}, smtp.QuitCmd{})
+		proto.answers = append(proto.answers[:4], smtp.Answer{Status: smtp.Ok}, smtp.Answer{Status: smtp.Closing})
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeTrue)
+		c.So(proto.GetState().User.Username(), c.ShouldEqual, "user@example.com")
+	})
+
+	c.Convey("Testing OAUTHBEARER with a prompted response without authzid", t, func(ctx c.C) {
+		proto := oauth("OAUTHBEARER", "", encode("n,,\x01auth=Bearer valid-token\x01\x01")+"\r\n",
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.AuthenticationSucceeded},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeTrue)
+		c.So(proto.GetState().User.Username(), c.ShouldEqual, "token-owner@example.com")
+	})
+
+	c.Convey("Testing OAUTHBEARER with an invalid token", t, func(ctx c.C) {
+		proto := oauth("OAUTHBEARER", encode("n,a=user@example.com,\x01auth=Bearer invalid-token\x01\x01"), "AQ==\r\n",
+			smtp.Answer{Status: smtp.EncodedString, Message: encode(`{"status":"invalid_token","schemes":"bearer","scope":"mail"}`)},
+			smtp.Answer{Status: smtp.AuthenticationCredentialsInvalid, EnhancedCode: smtp.EnhancedCode{5, 7, 8}},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeFalse)
+	})
+
+	c.Convey("Testing OAUTHBEARER with a malformed response", t, func(ctx c.C) {
+		proto := oauth("OAUTHBEARER", encode("n,user@example.com,\x01auth=Bearer valid-token\x01\x01"), "",
+			smtp.Answer{Status: smtp.MalformedAuthInput},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeFalse)
+	})
+
+	c.Convey("Testing XOAUTH2 with a valid token", t, func(ctx c.C) {
+		proto := oauth("XOAUTH2", encode("user=user@example.com\x01auth=Bearer valid-token\x01\x01"), "",
+			smtp.Answer{Status: smtp.AuthenticationSucceeded},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeTrue)
+		c.So(proto.GetState().User.Username(), c.ShouldEqual, "user@example.com")
+	})
+
+	c.Convey("Testing XOAUTH2 with an invalid token", t, func(ctx c.C) {
+		proto := oauth("XOAUTH2", encode("user=user@example.com\x01auth=Bearer invalid-token\x01\x01"), "\r\n",
+			smtp.Answer{Status: smtp.EncodedString, Message: encode(`{"status":"401","schemes":"Bearer"}`)},
+			smtp.Answer{Status: smtp.AuthenticationCredentialsInvalid},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeFalse)
+	})
+
+	c.Convey("Testing parsing of OAuth responses", t, func() {
+		username, authorizationIdentity, token, err := parseOAuthBearerResponse([]byte("n,a=a=3Db@example.com,\x01auth=bearer token\x01\x01"))
+		c.So(err, c.ShouldBeNil)
+		c.So(username, c.ShouldEqual, "a=b@example.com")
+		c.So(authorizationIdentity, c.ShouldEqual, "a=b@example.com")
+		c.So(token, c.ShouldEqual, "token")
+
+		for _, response := range []string{"", "n,,", "n,,\x01auth=Bearer token\x01", "n,,\x01host=example.com\x01\x01", "p=tls-unique,,\x01auth=Bearer token\x01\x01", "n,,\x01auth=Basic dXNlcjpwYXNz\x01\x01"} {
+			_, _, _, err = parseOAuthBearerResponse([]byte(response))
+			c.So(err, c.ShouldNotBeNil)
+		}
+
+		username, authorizationIdentity, token, err = parseXOAuth2Response([]byte("user=someuser@example.com\x01auth=Bearer ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg\x01\x01"))
+		c.So(err, c.ShouldBeNil)
+		c.So(username, c.ShouldEqual, "someuser@example.com")
+		c.So(authorizationIdentity, c.ShouldBeEmpty)
+		c.So(token, c.ShouldEqual, "ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg")
+
+		for _, response := range []string{"", "auth=Bearer token\x01\x01", "user=someuser@example.com\x01auth=Bearer token"} {
+			_, _, _, err = parseXOAuth2Response([]byte(response))
+			c.So(err, c.ShouldNotBeNil)
+		}
+	})
+}
+
+// testCertificateMapper maps certificates to the user in the common name.
+type testCertificateMapper struct{}
+
+func (m testCertificateMapper) MapCertificate(state *smtp.State, chain []*x509.Certificate) (User, error) {
+	if chain[0].Subject.CommonName == "" {
+		return nil, ErrInvalidCredentials
+	}
+	return &SMTPUser{username: chain[0].Subject.CommonName}, nil
+}
+
+func TestExternalMechanism(t *testing.T) {
+	cfg := Config{
+		Hostname: "home.sweet.home",
+	}
+
+	mta := New(cfg, HandlerFunc(dummyHandler))
+	if mta == nil {
+		t.Fatal("Could not create mta server")
+	}
+	mta.TlsConfig = &tls.Config{}
+	mta.CertificateMapper = testCertificateMapper{}
+	mta.RegisterSASLMechanism(ExternalMechanism{})
+
+	chain := func(commonName string) [][]*x509.Certificate {
+		return [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: commonName}}}}
+	}
+
+	external := func(initialResponse string, responses string, answers ...interface{}) *testProtocol {
+		proto := &testProtocol{
+			expectTLS: true,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.StartTlsCmd{},
+				smtp.AuthCmd{
+					Mechanism:       "EXTERNAL",
+					InitialResponse: initialResponse,
+					R:               bufio.NewReader(bytes.NewReader([]byte(responses))),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status: smtp.Ready,
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ready,
+				},
+			},
+		}
+		proto.answers = append(proto.answers, answers...)
+		proto.answers = append(proto.answers, smtp.Answer{
+			Status: smtp.Closing,
+		})
+		return proto
+	}
+
+	c.Convey("Testing AUTH EXTERNAL with a client certificate", t, func(ctx c.C) {
+		proto := external("=", "",
+			smtp.Answer{Status: smtp.AuthenticationSucceeded},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		proto.state.VerifiedChains = chain("user@example.com")
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeTrue)
+		c.So(proto.GetState().User.Username(), c.ShouldEqual, "user@example.com")
+	})
+
+	c.Convey("Testing AUTH EXTERNAL with a prompted authorization identity", t, func(ctx c.C) {
+		proto := external("", base64.StdEncoding.EncodeToString([]byte("user@example.com"))+"\r\n",
+			smtp.Answer{Status: smtp.EncodedString},
+			smtp.Answer{Status: smtp.AuthenticationSucceeded},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		proto.state.VerifiedChains = chain("user@example.com")
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeTrue)
+	})
+
+	c.Convey("Testing AUTH EXTERNAL as another user", t, func(ctx c.C) {
+		proto := external(base64.StdEncoding.EncodeToString([]byte("other@example.com")), "",
+			smtp.Answer{Status: smtp.AuthenticationCredentialsInvalid},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		proto.state.VerifiedChains = chain("user@example.com")
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeFalse)
+	})
+
+	c.Convey("Testing AUTH EXTERNAL without a client certificate", t, func(ctx c.C) {
+		proto := external("=", "",
+			smtp.Answer{Status: smtp.AuthenticationCredentialsInvalid},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeFalse)
+	})
+
+	c.Convey("Testing AUTH EXTERNAL with an unknown client certificate", t, func(ctx c.C) {
+		proto := external("=", "",
+			smtp.Answer{Status: smtp.AuthenticationCredentialsInvalid},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		proto.state.VerifiedChains = chain("")
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeFalse)
+	})
+}
+
+func TestAuthorizationIdentity(t *testing.T) {
+	cfg := Config{
+		Hostname: "home.sweet.home",
+	}
+
+	mta := New(cfg, HandlerFunc(dummyHandler))
+	if mta == nil {
+		t.Fatal("Could not create mta server")
+	}
+	mta.TlsConfig = &tls.Config{}
+	mta.AuthBackend = NewAuthBackendMemory(map[string]string{"helpdesk@example.com": "password1234"})
+	mta.Authorizer = NewAuthorizerMemory(map[string][]string{"helpdesk@example.com": {"support@example.com"}})
+
+	plain := func(authorizationIdentity string, answers ...interface{}) *testProtocol {
+		initialResponse := base64.StdEncoding.EncodeToString([]byte(authorizationIdentity + "\x00helpdesk@example.com\x00password1234"))
+		proto := &testProtocol{
+			expectTLS: true,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.StartTlsCmd{},
+				smtp.AuthCmd{
+					Mechanism:       "PLAIN",
+					InitialResponse: initialResponse,
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status: smtp.Ready,
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ready,
+				},
+			},
+		}
+		proto.answers = append(proto.answers, answers...)
+		proto.answers = append(proto.answers, smtp.Answer{
+			Status: smtp.Closing,
+		})
+		return proto
+	}
+
+	c.Convey("Testing AUTH acting as a shared mailbox", t, func(ctx c.C) {
+		proto := plain("support@example.com",
+			smtp.Answer{Status: smtp.AuthenticationSucceeded},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeTrue)
+		c.So(proto.GetState().User.Username(), c.ShouldEqual, "support@example.com")
+
+		user, ok := proto.GetState().User.(*AuthorizedUser)
+		c.So(ok, c.ShouldBeTrue)
+		c.So(user.Authenticated.Username(), c.ShouldEqual, "helpdesk@example.com")
+		c.So(user.Authorized.Username(), c.ShouldEqual, "support@example.com")
+	})
+
+	c.Convey("Testing AUTH with the authenticated user as authorization identity", t, func(ctx c.C) {
+		proto := plain("helpdesk@example.com",
+			smtp.Answer{Status: smtp.AuthenticationSucceeded},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeTrue)
+		c.So(proto.GetState().User, c.ShouldHaveSameTypeAs, &SMTPUser{})
+	})
+
+	c.Convey("Testing AUTH acting as a user which is not allowed", t, func(ctx c.C) {
+		proto := plain("ceo@example.com",
+			smtp.Answer{Status: smtp.AuthenticationCredentialsInvalid, EnhancedCode: smtp.EnhancedCode{5, 7, 8}},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeFalse)
+		c.So(proto.GetState().User, c.ShouldBeNil)
+	})
+
+	c.Convey("Testing AUTH acting as another user without Authorizer", t, func(ctx c.C) {
+		mta := New(cfg, HandlerFunc(dummyHandler))
+		mta.TlsConfig = &tls.Config{}
+		mta.AuthBackend = NewAuthBackendMemory(map[string]string{"helpdesk@example.com": "password1234"})
+
+		proto := plain("support@example.com",
+			smtp.Answer{Status: smtp.AuthenticationCredentialsInvalid},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Authenticated, c.ShouldBeFalse)
+	})
+}
@@ -1,10 +1,13 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,8 +22,43 @@ type Config struct {
 	Blacklist   Blacklist
 	DisableAuth bool
 	TLSConfig   *tls.Config
+	// MaxMessageSize is the maximum size of a message in bytes (RFC 1870).
+	// 0 means no limit.
+	MaxMessageSize int64
+	// LMTP enables LMTP mode (RFC 2033): LHLO replaces HELO and EHLO and
+	// a reply is sent for every recipient after the message data.
+	LMTP bool
+	// SocketPath is the path of a Unix socket to listen on instead of Ip and Port.
+	SocketPath string
+	// ImplicitTLS makes ListenAndServe start TLS on every connection before the greeting
+	// (RFC 8314, usually on port 465) instead of offering STARTTLS.
+	ImplicitTLS bool
+	// TrustedNetworks are the networks of proxies which are allowed to use
+	// the XCLIENT and XFORWARD commands to pass the attributes of the original client.
+	TrustedNetworks []*net.IPNet
+	// ProxyProtocolNetworks are the networks of load balancers which send a PROXY protocol
+	// (version 1 or 2) header at the start of every connection with the address of the original client.
+	// Connections from other networks are handled as direct connections.
+	ProxyProtocolNetworks []*net.IPNet
+	// HandlerTimeout is the deadline of the context of a ContextHandler for every mail.
+	// 0 means no deadline.
+	HandlerTimeout time.Duration
+	// MinDeliverByTime is the minimum by-time of the BY parameter (RFC 2852) with the return mode,
+	// shorter times are rejected because the message can't be delivered in time.
+	MinDeliverByTime time.Duration
+	// VerifyAuthenticated allows authenticated clients to use VRFY and EXPN.
+	VerifyAuthenticated bool
+	// VerifyNetworks are the networks of clients which are allowed to use VRFY and EXPN.
+	// Other clients get 252 for VRFY and 502 for EXPN, as if the commands are disabled.
+	VerifyNetworks []*net.IPNet
+	// Timeouts are the times the server waits for the client.
+	// The zero value means no timeouts, DefaultTimeouts has the values of RFC 5321.
+	Timeouts Timeouts
 }
 
+// The time a load balancer has to send the PROXY header if there are no Timeouts.
+const proxyHeaderTimeout = 10 * time.Second
+
 // Session id
 
 var globalCounter uint32 = 0
@@ -46,6 +84,33 @@ func (h HandlerFunc) Handle(state *smtp.State) error {
 	return h(state)
 }
 
+// RecipientErrors can be returned by a Handler to report a result per recipient.
+// It contains one entry for every recipient in State.To, nil if the mail was delivered to that recipient.
+//
+// In LMTP mode a reply is sent for every recipient. An SMTP server can only send one reply,
+// so the first error is used.
+type RecipientErrors []error
+
+func (e RecipientErrors) Error() string {
+	errs := []string{}
+	for i, err := range e {
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("recipient %d: %v", i, err))
+		}
+	}
+	return strings.Join(errs, "; ")
+}
+
+// first returns the first error, nil if the mail was delivered to all recipients.
+func (e RecipientErrors) first() error {
+	for _, err := range e {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Server Represents an SMTP server
 type Server struct {
 	config Config
@@ -54,12 +119,43 @@ type Server struct {
 	// The config for tls connection. Nil if not supported.
 	TlsConfig   *tls.Config
 	AuthBackend AuthBackend
+	// The policy for acting as another user after AUTH. Nil if not allowed.
+	Authorizer Authorizer
+	// The validator for bearer tokens of the OAUTHBEARER and XOAUTH2 mechanisms.
+	TokenValidator TokenValidator
+	// The mapper of TLS client certificates to users for the EXTERNAL mechanism.
+	CertificateMapper CertificateMapper
+	// The verifier of users for VRFY. Nil if VRFY is disabled.
+	Verifier Verifier
+	// The expander of mailing lists for EXPN. Nil if EXPN is disabled.
+	ListExpander ListExpander
+	// The queue runner for ETRN. Nil if ETRN is not supported.
+	QueueRunner QueueRunner
+	// The policies which are checked at each stage of a session. Nil accepts everything.
+	ConnectPolicy ConnectPolicy
+	HeloPolicy    HeloPolicy
+	MailPolicy    MailPolicy
+	RcptPolicy    RcptPolicy
+	DataPolicy    DataPolicy
+	// The registered SASL mechanisms for the AUTH command, by name.
+	saslMechanisms map[string]SASLMechanism
+	// The names of the registered SASL mechanisms in order of registration.
+	saslMechanismNames []string
 	// When shutting down this channel is closed, no new connections should be handled then.
 	// But existing connections can continue untill quitC is closed.
-	shutDownC chan bool
+	shutDownC    chan bool
+	shutDownOnce sync.Once
 	// When this is closed existing connections should stop.
-	quitC chan bool
-	wg    sync.WaitGroup
+	quitC    chan bool
+	quitOnce sync.Once
+	// The context of all sessions, cancelled when quitC is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// The number of running sessions and the open connections, for Shutdown.
+	mu       sync.Mutex
+	sessions int
+	conns    map[net.Conn]struct{}
 }
 
 // New Create a new SMTP server that doesn't handle the protocol.
@@ -71,21 +167,20 @@ func New(c Config, h Handler) *Server {
 		shutDownC:   make(chan bool),
 		TlsConfig:   c.TLSConfig,
 	}
+	mta.ctx, mta.cancel = context.WithCancel(context.Background())
 
 	// TODO what if authbackend is nil?
+	mta.RegisterSASLMechanism(PlainMechanism{})
+	mta.RegisterSASLMechanism(LoginMechanism{})
 
 	return mta
 }
 
+// Stop shuts the server down, existing sessions get a maximum of 10 seconds to finish.
 func (s *Server) Stop() {
-	log.Printf("Received stop command. Sending shutdown event...")
-	close(s.shutDownC)
-	// Give existing connections some time to finish.
-	t := time.Duration(10)
-	log.Printf("Waiting for a maximum of %d seconds...", t)
-	time.Sleep(t * time.Second)
-	log.Printf("Sending force quit event...")
-	close(s.quitC)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_ = s.Shutdown(ctx)
 }
 
 func (s *Server) hasTls() bool {
@@ -110,14 +205,43 @@ func (s *DefaultMta) Stop() {
 	s.Server.Stop()
 }
 
+// Shutdown stops the server gracefully, see Server.Shutdown.
+func (s *DefaultMta) Shutdown(ctx context.Context) error {
+	return s.Server.Shutdown(ctx)
+}
+
+// ListenAndServe listens on the configured address and serves SMTP on it.
+// With Config.ImplicitTLS every connection starts with a TLS handshake.
 func (s *DefaultMta) ListenAndServe() error {
-	log.Printf("Starting SMTP server at port %d", s.Server.config.Port)
-	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.Server.config.Ip, s.Server.config.Port))
+	ln, err := s.newListener()
 	if err != nil {
 		log.Errorf("Could not start listening: %v", err)
 		return err
 	}
 
+	if s.Server.config.ImplicitTLS {
+		return s.ServeTLS(ln)
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves SMTP on the connections of the listener, STARTTLS is offered if a TlsConfig is set.
+// Serve can be called for multiple listeners, it returns after a shutdown when all connections are closed.
+func (s *DefaultMta) Serve(ln net.Listener) error {
+	return s.serveListener(ln, false)
+}
+
+// ServeTLS serves SMTP with implicit TLS (RFC 8314) on the connections of the listener,
+// using the TlsConfig of the server.
+func (s *DefaultMta) ServeTLS(ln net.Listener) error {
+	if !s.Server.hasTls() {
+		ln.Close()
+		return fmt.Errorf("implicit TLS requires a TLS config")
+	}
+	return s.serveListener(ln, true)
+}
+
+func (s *DefaultMta) serveListener(ln net.Listener, implicitTLS bool) error {
 	// Close the listener so that listen well return from ln.Accept().
 	go func() {
 		_, ok := <-s.Server.shutDownC
@@ -126,13 +250,31 @@ func (s *DefaultMta) ListenAndServe() error {
 		}
 	}()
 
-	err = s.listen(ln)
+	err := s.listen(ln, implicitTLS)
 	log.Printf("Waiting for connections to close...")
 	s.Server.wg.Wait()
 	return err
 }
 
-func (s *DefaultMta) listen(ln net.Listener) error {
+// newListener listens on the Unix socket if a SocketPath is configured, on the tcp port otherwise.
+func (s *DefaultMta) newListener() (net.Listener, error) {
+	if s.Server.config.SocketPath == "" {
+		log.Printf("Starting SMTP server at port %d", s.Server.config.Port)
+		return net.Listen("tcp", fmt.Sprintf("%s:%d", s.Server.config.Ip, s.Server.config.Port))
+	}
+
+	log.Printf("Starting SMTP server at socket %s", s.Server.config.SocketPath)
+	// Remove a stale socket of a previous run.
+	if info, err := os.Stat(s.Server.config.SocketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(s.Server.config.SocketPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", s.Server.config.SocketPath)
+}
+
+func (s *DefaultMta) listen(ln net.Listener, implicitTLS bool) error {
 	defer ln.Close()
 	for {
 		c, err := ln.Accept()
@@ -146,13 +288,40 @@ func (s *DefaultMta) listen(ln net.Listener) error {
 		}
 
 		s.Server.wg.Add(1)
-		go s.serve(c)
+		s.Server.trackConn(c, true)
+		go s.serve(c, implicitTLS)
 	}
 
 }
 
-func (s *DefaultMta) serve(c net.Conn) {
+func (s *DefaultMta) serve(c net.Conn, implicitTLS bool) {
 	defer s.Server.wg.Done()
+	defer s.Server.trackConn(c, false)
+
+	if s.Server.isProxyProtocolNetwork(c.RemoteAddr()) {
+		proxyCon, err := s.readProxyHeader(c)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Ip": c.RemoteAddr().String(),
+			}).Warningf("Could not read PROXY header: %v", err)
+			c.Close()
+			return
+		}
+		c = proxyCon
+	}
+
+	if implicitTLS {
+		tlsCon := tls.Server(c, s.Server.TlsConfig)
+		err := s.handshake(c, tlsCon)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Ip": c.RemoteAddr().String(),
+			}).Warningf("Could not enable TLS: %v", err)
+			c.Close()
+			return
+		}
+		c = tlsCon
+	}
 
 	proto := smtp.NewMtaProtocol(c)
 	if proto == nil {
@@ -163,6 +332,59 @@ func (s *DefaultMta) serve(c net.Conn) {
 	s.Server.HandleClient(proto)
 }
 
+// readProxyHeader reads the PROXY header, the load balancer must send it immediately.
+func (s *DefaultMta) readProxyHeader(c net.Conn) (*smtp.ProxyConn, error) {
+	timeout := s.Server.connectTimeout()
+	if timeout == 0 {
+		timeout = proxyHeaderTimeout
+	}
+	err := c.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	proxyCon, err := smtp.NewProxyConn(c)
+	if err != nil {
+		return nil, err
+	}
+	err = c.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return proxyCon, nil
+}
+
+// handshake does the TLS handshake of implicit TLS on the connection c, within the connectTimeout.
+func (s *DefaultMta) handshake(c net.Conn, tlsCon *tls.Conn) error {
+	timeout := s.Server.connectTimeout()
+	if timeout == 0 {
+		return tlsCon.Handshake()
+	}
+
+	err := c.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return err
+	}
+	err = tlsCon.Handshake()
+	if err != nil {
+		return err
+	}
+	return c.SetDeadline(time.Time{})
+}
+
+// isProxyProtocolNetwork returns whether the address is in one of the ProxyProtocolNetworks.
+func (s *Server) isProxyProtocolNetwork(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range s.config.ProxyProtocolNetworks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
 // HandleClient Start communicating with a client
 func (s *Server) HandleClient(proto smtp.Protocol) {
 	//log.Printf("Received connection")
@@ -173,39 +395,54 @@ func (s *Server) HandleClient(proto smtp.Protocol) {
 	state.SessionId = generateSessionId()
 	state.Ip = proto.GetIP()
 
+	s.trackSession(true)
+	defer s.trackSession(false)
+	s.setSessionDeadline(proto)
+
+	// The context of the session is cancelled when the session ends or the server stops.
+	ctx, cancel := context.WithCancel(context.WithValue(s.ctx, sessionIdKey, state.SessionId))
+	defer cancel()
+	// Trust is based on the address of the connection, not on the address passed by XCLIENT.
+	trusted := s.isTrustedProxy(state.Ip)
+	// Set when a proxy passed the HELO name of the original client, which the HELO of the proxy must not override.
+	proxyHelo := false
+	// The message of the BDAT commands while it is streamed to a StreamHandler.
+	var bdat *bdatStream
+	// abortBdat ends the streamed message of the BDAT commands with the error.
+	abortBdat := func(err error) {
+		if bdat != nil {
+			_ = bdat.finish(err)
+			bdat = nil
+		}
+	}
+
 	log.WithFields(log.Fields{
 		"SessionId": state.SessionId.String(),
 		"Ip":        state.Ip.String(),
 	}).Debug("Received connection")
 
-	if s.config.Blacklist != nil {
-		if s.config.Blacklist.CheckIp(state.Ip.String()) {
-			log.WithFields(log.Fields{
-				"SessionId": state.SessionId.String(),
-				"Ip":        state.Ip.String(),
-			}).Warn("IP found in Blacklist, closing handler")
-			proto.Close()
-		} else {
-			log.WithFields(log.Fields{
-				"SessionId": state.SessionId.String(),
-				"Ip":        state.Ip.String(),
-			}).Debug("IP not found in Blacklist")
-		}
+	if s.isBlacklisted(state) {
+		proto.Close()
+	}
+
+	if err := s.checkConnect(state); err != nil {
+		proto.Send(s.policyAnswer(state, err))
+		proto.Close()
+		return
 	}
 
 	// Start with welcome message
-	proto.Send(smtp.Answer{
-		Status:  smtp.Ready,
-		Message: s.config.Hostname + " Service Ready",
-	})
+	proto.Send(s.greeting())
 
 	var c *smtp.Cmd
 	var err error
 
 	quit := false
-	cmdC := make(chan bool)
+	// Buffered so the reading goroutine can finish when the session stops without waiting for a command.
+	cmdC := make(chan bool, 1)
 
 	nextCmd := func() bool {
+		setTimeout(proto, s.commandTimeout(state))
 		go func() {
 			for {
 				c, err = proto.GetCmd()
@@ -213,10 +450,18 @@ func (s *Server) HandleClient(proto smtp.Protocol) {
 				if err != nil {
 					if err == smtp.ErrLtl {
 						proto.Send(smtp.Answer{
-							Status:  smtp.SyntaxError,
-							Message: "Line too long.",
+							Status:       smtp.SyntaxError,
+							EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+							Message:      "Line too long.",
 						})
 					} else {
+						if err == smtp.ErrTimeout {
+							log.WithFields(log.Fields{
+								"SessionId": state.SessionId.String(),
+								"Ip":        state.Ip.String(),
+							}).Debug("Timeout waiting for command")
+							proto.Send(timeoutAnswer)
+						}
 						// Not a line too long error. What to do?
 						cmdC <- true
 						return
@@ -228,21 +473,25 @@ func (s *Server) HandleClient(proto smtp.Protocol) {
 			cmdC <- false
 		}()
 
-		select {
-		case _, ok := <-s.quitC:
-			if !ok {
-				proto.Send(smtp.Answer{
-					Status:  smtp.ShuttingDown,
-					Message: "Server is going down.",
-				})
-				return true
+		shutDownC := s.shutDownC
+		for {
+			select {
+			case _, ok := <-s.quitC:
+				if !ok {
+					proto.Send(shuttingDownAnswer)
+					return true
+				}
+			case <-shutDownC:
+				if state.From == nil {
+					proto.Send(shuttingDownAnswer)
+					return true
+				}
+				// The client can finish the mail transaction untill the server quits.
+				shutDownC = nil
+			case q := <-cmdC:
+				return q
 			}
-		case q := <-cmdC:
-			return q
-
 		}
-
-		return false
 	}
 
 	quit = nextCmd()
@@ -253,85 +502,221 @@ func (s *Server) HandleClient(proto smtp.Protocol) {
 
 		switch cmd := (*c).(type) {
 		case smtp.HeloCmd:
-			state.Hostname = cmd.Domain
+			if s.config.LMTP {
+				s.sendUnknownCmd(proto)
+				break
+			}
+			if err := s.checkHelo(state, cmd.Domain); err != nil {
+				proto.Send(s.policyAnswer(state, err))
+				break
+			}
+			if !proxyHelo {
+				state.Hostname = cmd.Domain
+			}
 			proto.Send(smtp.Answer{
 				Status:  smtp.Ok,
 				Message: s.config.Hostname,
 			})
 
 		case smtp.EhloCmd:
+			if s.config.LMTP {
+				s.sendUnknownCmd(proto)
+				break
+			}
 			state.Reset()
-			state.Hostname = cmd.Domain
-
-			messages := []string{s.config.Hostname, "8BITMIME"}
-			if s.hasTls() && !state.Secure {
-				messages = append(messages, "STARTTLS")
+			if err := s.checkHelo(state, cmd.Domain); err != nil {
+				proto.Send(s.policyAnswer(state, err))
+				break
 			}
-
-			if !s.config.DisableAuth && s.AuthBackend != nil {
-				messages = append(messages, "AUTH PLAIN")
+			if !proxyHelo {
+				state.Hostname = cmd.Domain
 			}
 
-			messages = append(messages, "OK")
+			proto.Send(smtp.MultiAnswer{
+				Status:   smtp.Ok,
+				Messages: s.extensions(state, trusted),
+			})
+
+		case smtp.LhloCmd:
+			// LMTP uses LHLO instead of HELO and EHLO, it has the same semantics as EHLO (RFC 2033 4.1).
+			if !s.config.LMTP {
+				s.sendUnknownCmd(proto)
+				break
+			}
+			state.Reset()
+			if err := s.checkHelo(state, cmd.Domain); err != nil {
+				proto.Send(s.policyAnswer(state, err))
+				break
+			}
+			if !proxyHelo {
+				state.Hostname = cmd.Domain
+			}
 
 			proto.Send(smtp.MultiAnswer{
 				Status:   smtp.Ok,
-				Messages: messages,
+				Messages: s.extensions(state, trusted),
 			})
 
 		case smtp.QuitCmd:
 			proto.Send(smtp.Answer{
-				Status:  smtp.Closing,
-				Message: "Bye!",
+				Status:       smtp.Closing,
+				EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+				Message:      "Bye!",
 			})
 			quit = true
 
 		case smtp.MailCmd:
 			if ok, reason := state.CanReceiveMail(); !ok {
 				proto.Send(smtp.Answer{
-					Status:  smtp.BadSequence,
-					Message: reason,
+					Status:       smtp.BadSequence,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+					Message:      reason,
 				})
 				break
 			}
 			if !s.config.DisableAuth && !state.Authenticated {
 				proto.Send(smtp.Answer{
-					Status:  smtp.AuthenticationRequired,
-					Message: "Authentication Required",
+					Status:       smtp.AuthenticationRequired,
+					EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+					Message:      "Authentication Required",
 				})
 				break
 			}
 
+			/*
+				RFC 1870 6.
+
+				If the estimated size of the message exceeds the fixed maximum
+				message size, the server should return a 552 reply.
+			*/
+			if s.config.MaxMessageSize > 0 && cmd.Size > s.config.MaxMessageSize {
+				proto.Send(smtp.Answer{
+					Status:       smtp.AbortMail,
+					EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+					Message:      "Message size exceeds fixed maximum message size",
+				})
+				break
+			}
+
+			/*
+				RFC 6531 3.5
+
+				If the SMTPUTF8 parameter isn't given, addresses must be ASCII.
+			*/
+			if !cmd.SMTPUTF8 && !cmd.From.IsASCII() {
+				proto.Send(smtp.Answer{
+					Status:       smtp.SMTPErrorPermanentMailboxNameNotAllowed.Status,
+					EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+					Message:      "Non-ASCII addresses require SMTPUTF8",
+				})
+				break
+			}
+
+			// Handlers get an internationalized domain in its A-label form, whichever form the client used.
+			cmd.From.NormalizeDomain()
+
+			// REQUIRETLS (RFC 8689) is only advertised on a TLS-protected session,
+			// a message can't require TLS if it arrived over a cleartext hop.
+			if cmd.RequireTLS && !state.Secure {
+				proto.Send(smtp.Answer{
+					Status:       smtp.EncryptionNeeded,
+					EnhancedCode: smtp.EnhancedCode{5, 7, 10},
+					Message:      "REQUIRETLS requires a TLS-protected session",
+				})
+				break
+			}
+
+			if cmd.DeliverBy != nil && cmd.DeliverBy.Mode == smtp.DeliverByReturn && cmd.DeliverBy.Time < s.config.MinDeliverByTime {
+				proto.Send(smtp.Answer{
+					Status:       smtp.SyntaxErrorParam,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+					Message:      fmt.Sprintf("BY time is shorter than the minimum of %d seconds", int64(s.config.MinDeliverByTime/time.Second)),
+				})
+				break
+			}
+
+			if err := s.checkMail(state, cmd); err != nil {
+				proto.Send(s.policyAnswer(state, err))
+				break
+			}
+
 			state.From = cmd.From
 			state.EightBitMIME = cmd.EightBitMIME
+			state.SMTPUTF8 = cmd.SMTPUTF8
+			state.DSNReturn = cmd.Return
+			state.EnvelopeId = cmd.EnvelopeId
+			state.RequireTLS = cmd.RequireTLS
+			state.Priority = cmd.Priority
+			state.DeliverBy = cmd.DeliverBy
+			if state.DeliverBy != nil {
+				state.DeliverBy.Deadline = time.Now().Add(state.DeliverBy.Time)
+			}
+			state.BinaryMIME = cmd.BinaryMIME
 			message := "Sender"
 			if state.EightBitMIME {
 				message += " and 8BITMIME"
 			}
+			if state.BinaryMIME {
+				message += " and BINARYMIME"
+			}
 			message += " ok"
 
 			proto.Send(smtp.Answer{
-				Status:  smtp.Ok,
-				Message: message,
+				Status:       smtp.Ok,
+				EnhancedCode: smtp.EnhancedCode{2, 1, 0},
+				Message:      message,
 			})
 
 		case smtp.RcptCmd:
 			if ok, reason := state.CanReceiveRcpt(); !ok {
 				proto.Send(smtp.Answer{
-					Status:  smtp.BadSequence,
-					Message: reason,
+					Status:       smtp.BadSequence,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+					Message:      reason,
 				})
 				break
 			}
 
-			state.To = append(state.To, cmd.To)
+			// The recipients of the message can't change while it is received with BDAT.
+			if len(state.Data) > 0 || bdat != nil {
+				proto.Send(smtp.Answer{
+					Status:       smtp.BadSequence,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+					Message:      "RCPT not allowed after BDAT",
+				})
+				break
+			}
+
+			if !state.SMTPUTF8 && !cmd.To.IsASCII() {
+				proto.Send(smtp.Answer{
+					Status:       smtp.SMTPErrorPermanentMailboxNameNotAllowed.Status,
+					EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+					Message:      "Non-ASCII addresses require SMTPUTF8",
+				})
+				break
+			}
+
+			// Handlers get an internationalized domain in its A-label form, whichever form the client used.
+			cmd.To.NormalizeDomain()
+
+			if err := s.checkRcpt(state, cmd); err != nil {
+				proto.Send(s.policyAnswer(state, err))
+				break
+			}
+
+			state.To = append(state.To, &smtp.Recipient{
+				MailAddress:       cmd.To,
+				Notify:            cmd.Notify,
+				OriginalRecipient: cmd.OriginalRecipient,
+			})
 
 			if !s.config.DisableAuth {
 				// TODO check if to/from email address allowed
 				if ok, reason := state.AuthMatchesRcptAndMail(); !ok {
 					proto.Send(smtp.Answer{
-						Status:  smtp.SMTPErrorPermanentMailboxNameNotAllowed.Status,
-						Message: reason,
+						Status:       smtp.SMTPErrorPermanentMailboxNameNotAllowed.Status,
+						EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+						Message:      reason,
 					})
 					state.Reset()
 					break
@@ -339,8 +724,9 @@ func (s *Server) HandleClient(proto smtp.Protocol) {
 			}
 
 			proto.Send(smtp.Answer{
-				Status:  smtp.Ok,
-				Message: "OK",
+				Status:       smtp.Ok,
+				EnhancedCode: smtp.EnhancedCode{2, 1, 5},
+				Message:      "OK",
 			})
 
 		case smtp.DataCmd:
@@ -356,12 +742,35 @@ func (s *Server) HandleClient(proto smtp.Protocol) {
 					MUST NOT be sent unless a 354 reply is received.
 				*/
 				proto.Send(smtp.Answer{
-					Status:  smtp.BadSequence,
-					Message: reason,
+					Status:       smtp.BadSequence,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+					Message:      reason,
+				})
+				break
+			}
+
+			/*
+				RFC 3030 3.
+
+				If a DATA command is issued after a MAIL command containing the
+				body-value of "BINARYMIME", a 503 "Bad sequence of commands"
+				response MUST be sent. DATA can't be mixed with BDAT either.
+			*/
+			if state.BinaryMIME || len(state.Data) > 0 || bdat != nil {
+				proto.Send(smtp.Answer{
+					Status:       smtp.BadSequence,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+					Message:      "BINARYMIME and BDAT require BDAT to send the message",
 				})
 				break
 			}
 
+			if err := s.checkData(state); err != nil {
+				proto.Send(s.policyAnswer(state, err))
+				state.Reset()
+				break
+			}
+
 			message := "Start"
 			if state.EightBitMIME {
 				message += " 8BITMIME"
@@ -372,23 +781,37 @@ func (s *Server) HandleClient(proto smtp.Protocol) {
 				Message: message,
 			})
 
+			cmd.R.SetMaxSize(s.config.MaxMessageSize)
+
+			data := s.dataReader(proto, &cmd.R)
+			if _, ok := s.MailHandler.(StreamHandler); ok {
+				quit = s.handleStream(ctx, proto, state, data)
+				break
+			}
+
 		tryAgain:
-			tmpData, err := io.ReadAll(&cmd.R)
+			tmpData, err := io.ReadAll(data)
+			if err == smtp.ErrTooLarge {
+				// The rest of the message was discarded, don't keep what we have read so far.
+				s.sendRejectAnswers(proto, state, messageErrorAnswer(err), true)
+				break
+			}
 			state.Data = append(state.Data, tmpData...)
 			if err == smtp.ErrLtl {
 				proto.Send(smtp.Answer{
 					// SyntaxError or 552 error? or something else?
-					Status:  smtp.SyntaxError,
-					Message: "Line too long",
+					Status:       smtp.SyntaxError,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+					Message:      "Line too long",
 				})
 				goto tryAgain
+			} else if err == smtp.ErrTimeout {
+				proto.Send(timeoutAnswer)
+				quit = true
+				break
 			} else if err == smtp.ErrIncomplete {
 				// I think this can only happen on a socket if it gets closed before receiving the full data.
-				proto.Send(smtp.Answer{
-					Status:  smtp.SyntaxError,
-					Message: "Could not parse mail data",
-				})
-				state.Reset()
+				s.sendRejectAnswers(proto, state, messageErrorAnswer(err), true)
 				break
 
 			} else if err != nil {
@@ -398,59 +821,123 @@ func (s *Server) HandleClient(proto smtp.Protocol) {
 				}).Panic(err)
 			}
 
-			// Handle mail
-			err = s.MailHandler.Handle(state)
-			if err != nil {
-				smtpErr, ok := err.(smtp.SMTPError)
-				if ok {
-					// known SMTP error, just return it
-					proto.Send(smtp.Answer(smtpErr))
-				} else {
-					// unknown internal server error
-					proto.Send(smtp.Answer{Status: 451, Message: "local error: something went wrong"})
-					log.WithFields(log.Fields{
-						"SessionId": state.SessionId.String(),
-						"Ip":        state.Ip.String(),
-					}).Errorf("couldn't handle mail: %v", err)
+			s.handleMail(ctx, proto, state)
+
+		case smtp.BdatCmd:
+			if ok, reason := state.CanReceiveData(); !ok {
+				/*
+					RFC 3030 2.
+
+					The BDAT data MUST be read by the receiver even if the BDAT
+					command is rejected.
+				*/
+				_, _ = io.Copy(io.Discard, cmd.R)
+				proto.Send(smtp.Answer{
+					Status:       smtp.BadSequence,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+					Message:      reason,
+				})
+				break
+			}
+
+			received := int64(len(state.Data))
+			if bdat != nil {
+				received = bdat.size
+			}
+			if s.config.MaxMessageSize > 0 && received+cmd.Size > s.config.MaxMessageSize {
+				_, _ = io.Copy(io.Discard, cmd.R)
+				abortBdat(smtp.ErrTooLarge)
+				s.sendRejectAnswers(proto, state, messageErrorAnswer(smtp.ErrTooLarge), cmd.Last)
+				break
+			}
+
+			if bdat == nil && len(state.Data) == 0 {
+				if err := s.checkData(state); err != nil {
+					_, _ = io.Copy(io.Discard, cmd.R)
+					s.sendRejectAnswers(proto, state, s.policyAnswer(state, err), cmd.Last)
+					break
 				}
+			}
+
+			setTimeout(proto, s.config.Timeouts.DataBlock)
+			var n int64
+			var err error
+			if _, ok := s.MailHandler.(StreamHandler); ok {
+				if bdat == nil {
+					bdat = s.startBdatStream(ctx, proto, state)
+				}
+				n, err = bdat.write(cmd.R)
 			} else {
-				// mail successfully handled!
+				var chunk []byte
+				chunk, err = io.ReadAll(cmd.R)
+				n = int64(len(chunk))
+				state.Data = append(state.Data, chunk...)
+			}
+			if err == smtp.ErrTimeout {
+				abortBdat(err)
+				proto.Send(timeoutAnswer)
+				quit = true
+				break
+			}
+			if err != nil || n != cmd.Size {
+				// I think this can only happen on a socket if it gets closed before receiving the full chunk.
+				abortBdat(smtp.ErrIncomplete)
+				s.sendRejectAnswers(proto, state, smtp.Answer{
+					Status:       smtp.SyntaxError,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+					Message:      "Could not read chunk",
+				}, cmd.Last)
+				break
+			}
+
+			if !cmd.Last {
 				proto.Send(smtp.Answer{
-					Status:  smtp.Ok,
-					Message: "Mail delivered",
+					Status:       smtp.Ok,
+					EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+					Message:      fmt.Sprintf("%d octets received", cmd.Size),
 				})
+				break
 			}
 
-			// Reset state after mail was handled so we can start from a clean slate.
-			state.Reset()
+			if bdat != nil {
+				err = bdat.finish(nil)
+				bdat = nil
+				s.sendMailAnswers(proto, state, err)
+				break
+			}
+			s.handleMail(ctx, proto, state)
 
 		case smtp.RsetCmd:
 			state.Reset()
 			proto.Send(smtp.Answer{
-				Status:  smtp.Ok,
-				Message: "OK",
+				Status:       smtp.Ok,
+				EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+				Message:      "OK",
 			})
 
 		case smtp.StartTlsCmd:
 			if !s.hasTls() {
 				proto.Send(smtp.Answer{
-					Status:  smtp.NotImplemented,
-					Message: "STARTTLS is not implemented",
+					Status:       smtp.NotImplemented,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+					Message:      "STARTTLS is not implemented",
 				})
 				break
 			}
 
 			if state.Secure {
 				proto.Send(smtp.Answer{
-					Status:  smtp.NotImplemented,
-					Message: "Already in TLS mode",
+					Status:       smtp.NotImplemented,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+					Message:      "Already in TLS mode",
 				})
 				break
 			}
 
 			proto.Send(smtp.Answer{
-				Status:  smtp.Ready,
-				Message: "Ready for TLS handshake",
+				Status:       smtp.Ready,
+				EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+				Message:      "Ready for TLS handshake",
 			})
 
 			err := proto.StartTls(s.TlsConfig)
@@ -471,14 +958,25 @@ func (s *Server) HandleClient(proto smtp.Protocol) {
 
 		case smtp.NoopCmd:
 			proto.Send(smtp.Answer{
-				Status:  smtp.Ok,
-				Message: "OK",
+				Status:       smtp.Ok,
+				EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+				Message:      "OK",
 			})
 
-		case smtp.VrfyCmd, smtp.ExpnCmd, smtp.SendCmd, smtp.SomlCmd, smtp.SamlCmd:
+		case smtp.VrfyCmd:
+			s.handleVrfy(proto, state, cmd)
+
+		case smtp.ExpnCmd:
+			s.handleExpn(proto, state, cmd)
+
+		case smtp.EtrnCmd:
+			s.handleEtrn(proto, state, cmd)
+
+		case smtp.SendCmd, smtp.SomlCmd, smtp.SamlCmd:
 			proto.Send(smtp.Answer{
-				Status:  smtp.NotImplemented,
-				Message: "Command not implemented",
+				Status:       smtp.NotImplemented,
+				EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+				Message:      "Command not implemented",
 			})
 
 		case smtp.InvalidCmd:
@@ -486,163 +984,234 @@ func (s *Server) HandleClient(proto smtp.Protocol) {
 			// invalid arguments. So we should send smtp.SyntaxErrorParam?
 			// Is InvalidCmd a good name for this kind of error?
 			proto.Send(smtp.Answer{
-				Status:  smtp.SyntaxErrorParam,
-				Message: cmd.Info,
+				Status:       smtp.SyntaxErrorParam,
+				EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+				Message:      cmd.Info,
 			})
 
 		case smtp.UnknownCmd:
-			proto.Send(smtp.Answer{
-				Status:  smtp.SyntaxError,
-				Message: "Command not recognized",
-			})
+			s.sendUnknownCmd(proto)
 
 		case smtp.AuthCmd:
+			s.handleAuth(proto, state, cmd)
 
-			// check whether the connection is secure
-			if !state.Secure {
-				proto.Send(smtp.Answer{
-					Status:  smtp.EncryptionRequiredForRequestedAuthenticationMechanism,
-					Message: "5.7.0 Must issue a STARTTLS command first.",
-				})
+		case smtp.XclientCmd:
+			if !s.checkProxyCommand(proto, state, trusted, xclientAttributes, cmd.Attributes) {
 				break
 			}
+			if _, ok := cmd.Attributes["HELO"]; ok {
+				proxyHelo = true
+			}
+			quit = s.handleXclient(proto, state, cmd)
 
-			// make sure to add auth mechanisms to the EHLO command
-			if cmd.Mechanism != "PLAIN" {
-				proto.Send(smtp.Answer{
-					Status:  smtp.UnrecognizedAuthenticationType,
-					Message: "5.7.4 Unrecognized authentication type",
-				})
+		case smtp.XforwardCmd:
+			if !s.checkProxyCommand(proto, state, trusted, xforwardAttributes, cmd.Attributes) {
 				break
 			}
-
-			initialResponse := ""
-
-			// If no credentials are not present in AUTH command, prompt the client for them.
-			if cmd.InitialResponse == "" {
-				//tmpData, err := ioutil.ReadAll(&cmd.R)
-				tmpData, err := smtp.ReadUntill('\n', smtp.MAX_CMD_LINE, &cmd.R)
-				initialResponse = string(tmpData)
-				if err != nil {
-					// I think this can only happen on a socket if it gets closed before receiving the full data.
-					log.WithFields(log.Fields{
-						"SessionId": state.SessionId.String(),
-					}).Warnln(err)
-					proto.Send(smtp.Answer{
-						Status:  smtp.MalformedAuthInput,
-						Message: "Could not parse auth data",
-					})
-					break
-
-				}
-			} else {
-				initialResponse = cmd.InitialResponse
+			if _, ok := cmd.Attributes["HELO"]; ok {
+				proxyHelo = true
 			}
+			s.handleXforward(proto, state, cmd)
 
-			authorizationIdentity, authenticationIdenity, password, err := smtp.ParseAuthPlainInitialRespone(initialResponse)
-			if err != nil {
+		default:
+			// TODO: We get here if the switch does not handle all Cmd's defined
+			// in protocol.go. That means we forgot to add it here. This should ideally
+			// be checked at compile time. But if we get here anyway we probably shouldn't
+			// crash...
+			log.Fatalf("Command not implemented: %#v", cmd)
+		}
 
-				log.WithFields(log.Fields{
-					"Ip":        state.Ip.String(),
-					"SessionId": state.SessionId.String(),
-				}).Warningf("Could not decode base64: %v", err)
+		// The mail transaction ended before the last chunk, e.g. with RSET or EHLO.
+		if bdat != nil && state.From == nil {
+			abortBdat(smtp.ErrIncomplete)
+		}
 
-				proto.Send(smtp.Answer{
-					Status:  smtp.SyntaxErrorParam,
-					Message: "Invalid initial response for PLAIN auth",
-				})
+		if quit {
+			break
+		}
 
-				break
+		quit = nextCmd()
+	}
 
-			}
+	// The client left without sending the last chunk.
+	abortBdat(smtp.ErrIncomplete)
+	proto.Close()
+	log.WithFields(log.Fields{
+		"SessionId": state.SessionId.String(),
+		"Ip":        state.Ip.String(),
+	}).Debug("Closed connection")
+}
 
-			log.WithFields(log.Fields{
-				"authorization-identity":  authorizationIdentity,
-				"authentication-identity": authenticationIdenity,
-				// "password":                "password",
-				// let's not log user passwords....
-			}).Debugln("received auth")
-
-			// Check if AuthBackend is initialized
-			if s.AuthBackend == nil {
-				log.Errorln("AuthBackend not initialized")
-				proto.Send(smtp.Answer{
-					Status:  smtp.TemporaryAuthenticationFailure,
-					Message: "4.7.0  Temporary authentication failure",
-				})
-				break
-			}
+var shuttingDownAnswer = smtp.Answer{
+	Status:       smtp.ShuttingDown,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Server is going down.",
+}
 
-			user, err := s.AuthBackend.Login(state, authenticationIdenity, password)
-			if err == ErrInvalidCredentials {
-				// Invalid credentials
-				state.Authenticated = false
+// greeting returns the welcome message.
+func (s *Server) greeting() smtp.Answer {
+	greeting := " Service Ready"
+	if s.config.LMTP {
+		greeting = " LMTP Service Ready"
+	}
+	return smtp.Answer{
+		Status:  smtp.Ready,
+		Message: s.config.Hostname + greeting,
+	}
+}
 
-				log.WithFields(log.Fields{
-					"Ip":        state.Ip.String(),
-					"SessionId": state.SessionId.String(),
-				}).Printf("invalid auth for user: %s", authenticationIdenity)
+// isBlacklisted checks the ip of the client in the Blacklist.
+func (s *Server) isBlacklisted(state *smtp.State) bool {
+	if s.config.Blacklist == nil {
+		return false
+	}
 
-				proto.Send(smtp.Answer{
-					Status:  smtp.AuthenticationCredentialsInvalid,
-					Message: "5.7.8  Authentication credentials invalid",
-				})
+	if s.config.Blacklist.CheckIp(state.Ip.String()) {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+			"Ip":        state.Ip.String(),
+		}).Warn("IP found in Blacklist, closing handler")
+		return true
+	}
 
-				break
-			}
-			if err != nil {
-				// Other error
-				state.Authenticated = false
+	log.WithFields(log.Fields{
+		"SessionId": state.SessionId.String(),
+		"Ip":        state.Ip.String(),
+	}).Debug("IP not found in Blacklist")
+	return false
+}
 
-				log.WithFields(log.Fields{
-					"Ip":        state.Ip.String(),
-					"SessionId": state.SessionId.String(),
-				}).Printf("authentication failed for user: %s with error: %v", authenticationIdenity, err)
+// handleMail passes a completely received mail to the MailHandler and sends the answer.
+func (s *Server) handleMail(ctx context.Context, proto smtp.Protocol, state *smtp.State) {
+	err := s.handle(ctx, proto, state, nil)
+	s.sendMailAnswers(proto, state, err)
+}
 
-				proto.Send(smtp.Answer{
-					Status:  smtp.TemporaryAuthenticationFailure,
-					Message: "4.7.0 Temporary authentication failure",
-				})
+// sendMailAnswers sends the answers for the result of the mail handler.
+func (s *Server) sendMailAnswers(proto smtp.Protocol, state *smtp.State, err error) {
+	recipientErrs, isRecipientErrs := err.(RecipientErrors)
+	if isRecipientErrs && len(recipientErrs) != len(state.To) {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+			"Ip":        state.Ip.String(),
+		}).Errorf("handler returned %d recipient errors for %d recipients", len(recipientErrs), len(state.To))
+		err = fmt.Errorf("invalid number of recipient errors")
+		isRecipientErrs = false
+	}
 
-				break
+	if s.config.LMTP {
+		/*
+			RFC 2033 4.2
+
+			After the final ".", the server returns one reply for each
+			previously successful RCPT command in the mail transaction, in the
+			order that the RCPT commands were issued.
+		*/
+		for i := range state.To {
+			if isRecipientErrs {
+				err = recipientErrs[i]
 			}
+			proto.Send(s.mailAnswer(state, err))
+		}
+	} else {
+		if isRecipientErrs {
+			err = recipientErrs.first()
+		}
+		proto.Send(s.mailAnswer(state, err))
+	}
+
+	// Reset state after mail was handled so we can start from a clean slate.
+	state.Reset()
+}
 
-			// Valid auth
+// sendRejectAnswers sends the answer which rejects the message and resets the state.
+// If it is the reply to the end of the message, there is one for every recipient in LMTP mode,
+// like the answers of the mail handler.
+func (s *Server) sendRejectAnswers(proto smtp.Protocol, state *smtp.State, answer smtp.Answer, endOfMessage bool) {
+	if s.config.LMTP && endOfMessage {
+		for range state.To {
+			proto.Send(answer)
+		}
+	} else {
+		proto.Send(answer)
+	}
 
-			state.Authenticated = true
-			state.User = user
+	state.Reset()
+}
 
-			log.WithFields(log.Fields{
-				"Ip":        state.Ip.String(),
-				"SessionId": state.SessionId.String(),
-			}).Printf("valid auth for user: %s", authenticationIdenity)
+// mailAnswer returns the answer for the result of the mail handler.
+func (s *Server) mailAnswer(state *smtp.State, err error) smtp.Answer {
+	if err == nil {
+		// mail successfully handled!
+		return smtp.Answer{
+			Status:       smtp.Ok,
+			EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+			Message:      "Mail delivered",
+		}
+	}
 
-			proto.Send(smtp.Answer{
-				Status:  smtp.AuthenticationSucceeded,
-				Message: "2.7.0 Authentication successful",
-			})
+	smtpErr, ok := err.(smtp.SMTPError)
+	if !ok {
+		// unknown internal server error
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+			"Ip":        state.Ip.String(),
+		}).Errorf("couldn't handle mail: %v", err)
+		return smtp.Answer{Status: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "local error: something went wrong"}
+	}
 
-			//initialResponseText := string(initialResponseByte)
-			//log.Fatalf("initial-response: %v", initialResponseText)
+	// known SMTP error, just return it
+	answer := smtp.Answer(smtpErr)
+	if answer.EnhancedCode.IsZero() {
+		// No enhanced code given by the handler, use the generic code of the class (RFC 3463 3.1).
+		answer.EnhancedCode = smtp.EnhancedCode{int(answer.Status / 100), 0, 0}
+	}
+	return answer
+}
 
-		default:
-			// TODO: We get here if the switch does not handle all Cmd's defined
-			// in protocol.go. That means we forgot to add it here. This should ideally
-			// be checked at compile time. But if we get here anyway we probably shouldn't
-			// crash...
-			log.Fatalf("Command not implemented: %#v", cmd)
-		}
+// extensions returns the lines of the EHLO/LHLO answer.
+// XCLIENT and XFORWARD are only advertised to trusted proxies.
+func (s *Server) extensions(state *smtp.State, trusted bool) []string {
+	messages := []string{s.config.Hostname, "8BITMIME", "PIPELINING", "CHUNKING", "BINARYMIME", "SMTPUTF8", "DSN", "ENHANCEDSTATUSCODES"}
+	if s.config.MaxMessageSize > 0 {
+		messages = append(messages, fmt.Sprintf("SIZE %d", s.config.MaxMessageSize))
+	} else {
+		messages = append(messages, "SIZE")
+	}
+	if s.config.MinDeliverByTime > 0 {
+		messages = append(messages, fmt.Sprintf("DELIVERBY %d", int64(s.config.MinDeliverByTime/time.Second)))
+	} else {
+		messages = append(messages, "DELIVERBY")
+	}
+	messages = append(messages, "MT-PRIORITY")
+	if s.hasTls() && !state.Secure {
+		messages = append(messages, "STARTTLS")
+	}
+	if state.Secure {
+		messages = append(messages, "REQUIRETLS")
+	}
+	if s.QueueRunner != nil {
+		messages = append(messages, "ETRN")
+	}
+	if trusted {
+		messages = append(messages, "XCLIENT "+strings.Join(xclientAttributes, " "))
+		messages = append(messages, "XFORWARD "+strings.Join(xforwardAttributes, " "))
+	}
 
-		if quit {
-			break
+	if !s.config.DisableAuth {
+		if mechanisms := s.saslMechanismsFor(state); len(mechanisms) > 0 {
+			messages = append(messages, "AUTH "+strings.Join(mechanisms, " "))
 		}
-
-		quit = nextCmd()
 	}
 
-	proto.Close()
-	log.WithFields(log.Fields{
-		"SessionId": state.SessionId.String(),
-		"Ip":        state.Ip.String(),
-	}).Debug("Closed connection")
+	messages = append(messages, "OK")
+	return messages
+}
+
+func (s *Server) sendUnknownCmd(proto smtp.Protocol) {
+	proto.Send(smtp.Answer{
+		Status:       smtp.SyntaxError,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+		Message:      "Command not recognized",
+	})
 }
@@ -3,11 +3,21 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
 	"io"
+	"math/big"
 	"net"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mistralmail/smtp/smtp"
 	c "github.com/smartystreets/goconvey/convey"
@@ -50,10 +60,20 @@ func (p *testProtocol) Send(cmd smtp.Cmd) {
 		p.ctx.So(cmdA, c.ShouldHaveSameTypeAs, answer)
 		cmdE, _ := answer.(smtp.Answer)
 		p.ctx.So(cmdA.Status, c.ShouldEqual, cmdE.Status)
+		if !cmdE.EnhancedCode.IsZero() {
+			p.ctx.So(cmdA.EnhancedCode, c.ShouldEqual, cmdE.EnhancedCode)
+		}
+		if cmdE.Status == smtp.EncodedString && cmdE.Message != "" {
+			// check the SASL challenge
+			p.ctx.So(cmdA.Message, c.ShouldEqual, cmdE.Message)
+		}
 	} else if cmdA, ok := cmd.(smtp.MultiAnswer); ok {
 		p.ctx.So(cmdA, c.ShouldHaveSameTypeAs, answer)
 		cmdE, _ := answer.(smtp.MultiAnswer)
 		p.ctx.So(cmdA.Status, c.ShouldEqual, cmdE.Status)
+		if len(cmdE.Messages) > 0 {
+			p.ctx.So(cmdA.Messages, c.ShouldResemble, cmdE.Messages)
+		}
 	} else {
 		p.t.Fatalf("Answer should be Answer or MultiAnswer")
 	}
@@ -1090,7 +1110,7 @@ func TestAuth(t *testing.T) {
 				smtp.AuthCmd{
 					Mechanism:       "PLAIN",
 					InitialResponse: "",
-					R:               *bufio.NewReader(bytes.NewReader([]byte("AHNvbWUtdXNlcm5hbWVAZXhhbXBsZS5jb20AcGFzc3dvcmQxMjM0\r\n"))),
+					R:               bufio.NewReader(bytes.NewReader([]byte("AHNvbWUtdXNlcm5hbWVAZXhhbXBsZS5jb20AcGFzc3dvcmQxMjM0\r\n"))),
 				},
 				smtp.QuitCmd{},
 			},
@@ -1106,6 +1126,10 @@ func TestAuth(t *testing.T) {
 				smtp.Answer{
 					Status: smtp.Ready,
 				},
+				smtp.Answer{
+					Status:  smtp.EncodedString,
+					Message: "",
+				},
 				smtp.Answer{
 					Status:  smtp.AuthenticationSucceeded,
 					Message: "2.7.0 Authentication successful",
@@ -1309,3 +1333,2593 @@ func TestAuth(t *testing.T) {
 	})
 
 }
+
+// Tests the SIZE extension
+func TestMaxMessageSize(t *testing.T) {
+	cfg := Config{
+		Hostname:       "home.sweet.home",
+		DisableAuth:    true,
+		MaxMessageSize: 10,
+	}
+
+	mta := New(cfg, HandlerFunc(dummyHandler))
+	if mta == nil {
+		t.Fatal("Could not create mta server")
+	}
+
+	c.Convey("Testing declared SIZE larger than maximum", t, func(ctx c.C) {
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.MailCmd{
+					From: getMailWithoutError("someone@somewhere.test"),
+					Size: 11,
+				},
+				smtp.MailCmd{
+					From: getMailWithoutError("someone@somewhere.test"),
+					Size: 10,
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.AbortMail,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing message growing past the maximum during DATA", t, func(ctx c.C) {
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.HeloCmd{
+					Domain: "some.sender",
+				},
+				smtp.MailCmd{
+					From: getMailWithoutError("someone@somewhere.test"),
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy1@somewhere.test"),
+				},
+				smtp.DataCmd{
+					R: *smtp.NewDataReader(bufio.NewReader(bytes.NewReader([]byte("Some test email that is too long\n.\n")))),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.StartData,
+				},
+				smtp.Answer{
+					Status: smtp.AbortMail,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+		c.So(proto.GetState().Data, c.ShouldBeEmpty)
+	})
+}
+
+// Tests the CHUNKING and BINARYMIME extensions
+func TestBdat(t *testing.T) {
+	cfg := Config{
+		Hostname:       "home.sweet.home",
+		DisableAuth:    true,
+		MaxMessageSize: 20,
+	}
+
+	var received []byte
+	mta := New(cfg, HandlerFunc(func(state *smtp.State) error {
+		received = state.Data
+		return nil
+	}))
+	if mta == nil {
+		t.Fatal("Could not create mta server")
+	}
+
+	bdat := func(data string, last bool) smtp.BdatCmd {
+		return smtp.BdatCmd{
+			Size: int64(len(data)),
+			Last: last,
+			R:    bytes.NewReader([]byte(data)),
+		}
+	}
+
+	c.Convey("Testing mail in multiple chunks", t, func(ctx c.C) {
+		received = nil
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.MailCmd{
+					From:       getMailWithoutError("someone@somewhere.test"),
+					BinaryMIME: true,
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy1@somewhere.test"),
+				},
+				bdat("Some \x00", false),
+				bdat("binary\r\n.\r\n", false),
+				bdat("", true),
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+		c.So(string(received), c.ShouldEqual, "Some \x00binary\r\n.\r\n")
+	})
+
+	c.Convey("Testing BDAT without MAIL, DATA with BINARYMIME and chunks that are too large", t, func(ctx c.C) {
+		received = nil
+		tooLarge := bdat("This chunk is larger than 20 bytes", true)
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				bdat("Some mail", true),
+				smtp.MailCmd{
+					From:       getMailWithoutError("someone@somewhere.test"),
+					BinaryMIME: true,
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy1@somewhere.test"),
+				},
+				smtp.DataCmd{},
+				tooLarge,
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.BadSequence,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.BadSequence,
+				},
+				smtp.Answer{
+					Status: smtp.AbortMail,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+		c.So(received, c.ShouldBeNil)
+		c.So(tooLarge.R.(*bytes.Reader).Len(), c.ShouldEqual, 0)
+	})
+}
+
+// Tests the SMTPUTF8 extension
+func TestSMTPUTF8(t *testing.T) {
+	cfg := Config{
+		Hostname:    "home.sweet.home",
+		DisableAuth: true,
+	}
+
+	mta := New(cfg, HandlerFunc(dummyHandler))
+	if mta == nil {
+		t.Fatal("Could not create mta server")
+	}
+
+	c.Convey("Testing UTF-8 addresses with and without SMTPUTF8", t, func(ctx c.C) {
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.MailCmd{
+					From: getMailWithoutError("δοκιμή@παράδειγμα.δοκιμή"),
+				},
+				smtp.MailCmd{
+					From: getMailWithoutError("someone@somewhere.test"),
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("用户@例子.广告"),
+				},
+				smtp.RsetCmd{},
+				smtp.MailCmd{
+					From:     getMailWithoutError("δοκιμή@παράδειγμα.δοκιμή"),
+					SMTPUTF8: true,
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("用户@例子.广告"),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.SMTPErrorPermanentMailboxNameNotAllowed.Status,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.SMTPErrorPermanentMailboxNameNotAllowed.Status,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+		c.So(proto.GetState().SMTPUTF8, c.ShouldBeTrue)
+		c.So(proto.GetState().To, c.ShouldHaveLength, 1)
+		c.So(proto.GetState().From.Address, c.ShouldEqual, "δοκιμή@xn--hxajbheg2az3al.xn--jxalpdlp")
+		c.So(proto.GetState().To[0].Address, c.ShouldEqual, "用户@xn--fsqu00a.xn--4rr70v")
+	})
+
+	c.Convey("Testing the U-label and A-label form of a domain", t, func(ctx c.C) {
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.MailCmd{
+					From:     getMailWithoutError("someone@somewhere.test"),
+					SMTPUTF8: true,
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("user@例子.广告"),
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("user@xn--fsqu00a.xn--4rr70v"),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{Status: smtp.Ready},
+				smtp.MultiAnswer{Status: smtp.Ok},
+				smtp.Answer{Status: smtp.Ok},
+				smtp.Answer{Status: smtp.Ok},
+				smtp.Answer{Status: smtp.Ok},
+				smtp.Answer{Status: smtp.Closing},
+			},
+		}
+		mta.HandleClient(proto)
+		c.So(proto.GetState().To, c.ShouldHaveLength, 2)
+		c.So(proto.GetState().To[0].Address, c.ShouldEqual, "user@xn--fsqu00a.xn--4rr70v")
+		c.So(proto.GetState().To[1].Address, c.ShouldEqual, proto.GetState().To[0].Address)
+	})
+}
+
+// Tests the DSN extension
+func TestDSN(t *testing.T) {
+	cfg := Config{
+		Hostname:    "home.sweet.home",
+		DisableAuth: true,
+	}
+
+	var received smtp.State
+	mta := New(cfg, HandlerFunc(func(state *smtp.State) error {
+		received = *state
+		return nil
+	}))
+	if mta == nil {
+		t.Fatal("Could not create mta server")
+	}
+
+	c.Convey("Testing DSN parameters are kept per recipient", t, func(ctx c.C) {
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.MailCmd{
+					From:       getMailWithoutError("someone@somewhere.test"),
+					Return:     smtp.DSNReturnHeaders,
+					EnvelopeId: "QQ314159",
+				},
+				smtp.RcptCmd{
+					To:     getMailWithoutError("guy1@somewhere.test"),
+					Notify: smtp.DSNNotifyNever,
+				},
+				smtp.RcptCmd{
+					To:                getMailWithoutError("guy2@somewhere.test"),
+					Notify:            smtp.DSNNotifySuccess | smtp.DSNNotifyFailure,
+					OriginalRecipient: &smtp.OriginalRecipient{AddressType: "rfc822", Address: "guy@somewhere.test"},
+				},
+				smtp.DataCmd{
+					R: *smtp.NewDataReader(bufio.NewReader(bytes.NewReader([]byte("Some test email\n.\n")))),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.StartData,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+
+		c.So(received.DSNReturn, c.ShouldEqual, smtp.DSNReturnHeaders)
+		c.So(received.EnvelopeId, c.ShouldEqual, "QQ314159")
+		c.So(received.To, c.ShouldHaveLength, 2)
+		c.So(received.To[0].Address, c.ShouldEqual, "guy1@somewhere.test")
+		c.So(received.To[0].Notify, c.ShouldEqual, smtp.DSNNotifyNever)
+		c.So(received.To[0].OriginalRecipient, c.ShouldBeNil)
+		c.So(received.To[1].Address, c.ShouldEqual, "guy2@somewhere.test")
+		c.So(received.To[1].Notify.Has(smtp.DSNNotifyFailure), c.ShouldBeTrue)
+		c.So(received.To[1].OriginalRecipient.Address, c.ShouldEqual, "guy@somewhere.test")
+	})
+}
+
+// Tests the REQUIRETLS extension
+func TestRequireTLS(t *testing.T) {
+	cfg := Config{
+		Hostname:    "home.sweet.home",
+		DisableAuth: true,
+	}
+
+	var received smtp.State
+	mta := New(cfg, HandlerFunc(func(state *smtp.State) error {
+		received = *state
+		return nil
+	}))
+	if mta == nil {
+		t.Fatal("Could not create mta server")
+	}
+
+	c.Convey("Testing REQUIRETLS is only advertised over TLS", t, func() {
+		c.So(mta.extensions(&smtp.State{}, false), c.ShouldNotContain, "REQUIRETLS")
+		c.So(mta.extensions(&smtp.State{Secure: true}, false), c.ShouldContain, "REQUIRETLS")
+	})
+
+	c.Convey("Testing REQUIRETLS on a cleartext session", t, func(ctx c.C) {
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.MailCmd{
+					From:       getMailWithoutError("someone@somewhere.test"),
+					RequireTLS: true,
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:       smtp.EncryptionNeeded,
+					EnhancedCode: smtp.EnhancedCode{5, 7, 10},
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing REQUIRETLS on a TLS session", t, func(ctx c.C) {
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.MailCmd{
+					From:       getMailWithoutError("someone@somewhere.test"),
+					RequireTLS: true,
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy1@somewhere.test"),
+				},
+				smtp.DataCmd{
+					R: *smtp.NewDataReader(bufio.NewReader(bytes.NewReader([]byte("Some test email\n.\n")))),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.StartData,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		proto.state.Secure = true
+		mta.HandleClient(proto)
+
+		c.So(received.RequireTLS, c.ShouldBeTrue)
+	})
+}
+
+// Tests enhanced status codes in answers
+func TestEnhancedStatusCodes(t *testing.T) {
+	cfg := Config{
+		Hostname:    "home.sweet.home",
+		DisableAuth: true,
+	}
+
+	handlerErr := smtp.SMTPErrorPermanentMailboxNotAvailable
+	mta := New(cfg, HandlerFunc(func(state *smtp.State) error {
+		return handlerErr
+	}))
+	if mta == nil {
+		t.Fatal("Could not create mta server")
+	}
+
+	mail := func(handlerCode smtp.EnhancedCode) *testProtocol {
+		return &testProtocol{
+			cmds: []smtp.Cmd{
+				smtp.HeloCmd{
+					Domain: "some.sender",
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy1@somewhere.test"),
+				},
+				smtp.MailCmd{
+					From: getMailWithoutError("someone@somewhere.test"),
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy1@somewhere.test"),
+				},
+				smtp.DataCmd{
+					R: *smtp.NewDataReader(bufio.NewReader(bytes.NewReader([]byte("Some test email\n.\n")))),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status: smtp.Ready,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:       smtp.BadSequence,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+				},
+				smtp.Answer{
+					Status:       smtp.Ok,
+					EnhancedCode: smtp.EnhancedCode{2, 1, 0},
+				},
+				smtp.Answer{
+					Status:       smtp.Ok,
+					EnhancedCode: smtp.EnhancedCode{2, 1, 5},
+				},
+				smtp.Answer{
+					Status: smtp.StartData,
+				},
+				smtp.Answer{
+					Status:       smtp.SMTPErrorPermanentMailboxNotAvailable.Status,
+					EnhancedCode: handlerCode,
+				},
+				smtp.Answer{
+					Status:       smtp.Closing,
+					EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+				},
+			},
+		}
+	}
+
+	c.Convey("Testing enhanced status code returned by the handler", t, func(ctx c.C) {
+		handlerErr = smtp.SMTPError{Status: smtp.MailboxUnavailable, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Delivery not authorized"}
+		proto := mail(smtp.EnhancedCode{5, 7, 1})
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing default enhanced status code if the handler doesn't return one", t, func(ctx c.C) {
+		handlerErr = smtp.SMTPError{Status: smtp.MailboxUnavailable, Message: "Delivery not authorized"}
+		proto := mail(smtp.EnhancedCode{5, 0, 0})
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+	})
+}
+
+// Tests LMTP mode
+func TestLMTP(t *testing.T) {
+	cfg := Config{
+		Hostname:    "home.sweet.home",
+		DisableAuth: true,
+		LMTP:        true,
+	}
+
+	var handlerErr error
+	mta := New(cfg, HandlerFunc(func(state *smtp.State) error {
+		return handlerErr
+	}))
+	if mta == nil {
+		t.Fatal("Could not create mta server")
+	}
+
+	lmtp := func(answers ...interface{}) *testProtocol {
+		proto := &testProtocol{
+			cmds: []smtp.Cmd{
+				smtp.HeloCmd{
+					Domain: "some.sender",
+				},
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.LhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.MailCmd{
+					From: getMailWithoutError("someone@somewhere.test"),
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy1@somewhere.test"),
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy2@somewhere.test"),
+				},
+				smtp.DataCmd{
+					R: *smtp.NewDataReader(bufio.NewReader(bytes.NewReader([]byte("Some test email\n.\n")))),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status: smtp.Ready,
+				},
+				smtp.Answer{
+					Status: smtp.SyntaxError,
+				},
+				smtp.Answer{
+					Status: smtp.SyntaxError,
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.StartData,
+				},
+			},
+		}
+		proto.answers = append(proto.answers, answers...)
+		proto.answers = append(proto.answers, smtp.Answer{
+			Status: smtp.Closing,
+		})
+		return proto
+	}
+
+	c.Convey("Testing a reply for every recipient", t, func(ctx c.C) {
+		handlerErr = nil
+		proto := lmtp(
+			smtp.Answer{Status: smtp.Ok},
+			smtp.Answer{Status: smtp.Ok},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing a different reply per recipient", t, func(ctx c.C) {
+		handlerErr = RecipientErrors{nil, smtp.SMTPErrorPermanentExceededStorage}
+		proto := lmtp(
+			smtp.Answer{Status: smtp.Ok},
+			smtp.Answer{Status: smtp.SMTPErrorPermanentExceededStorage.Status, EnhancedCode: smtp.EnhancedCode{5, 2, 2}},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing the same error for every recipient", t, func(ctx c.C) {
+		handlerErr = errors.New("some error")
+		proto := lmtp(
+			smtp.Answer{Status: 451},
+			smtp.Answer{Status: 451},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing an invalid number of recipient errors", t, func(ctx c.C) {
+		handlerErr = RecipientErrors{nil}
+		proto := lmtp(
+			smtp.Answer{Status: 451},
+			smtp.Answer{Status: 451},
+		)
+		proto.t = t
+		proto.ctx = ctx
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing a too large message", t, func(ctx c.C) {
+		cfg := cfg
+		cfg.MaxMessageSize = 10
+		handlers := []Handler{
+			HandlerFunc(func(state *smtp.State) error {
+				return nil
+			}),
+			StreamHandlerFunc(func(ctx context.Context, state *smtp.State, message io.Reader) error {
+				_, err := io.Copy(io.Discard, message)
+				return err
+			}),
+		}
+
+		for _, handler := range handlers {
+			mta := New(cfg, handler)
+			proto := lmtp(
+				smtp.Answer{Status: smtp.AbortMail, EnhancedCode: smtp.EnhancedCode{5, 3, 4}},
+				smtp.Answer{Status: smtp.AbortMail, EnhancedCode: smtp.EnhancedCode{5, 3, 4}},
+			)
+			proto.cmds[6] = smtp.DataCmd{
+				R: *smtp.NewDataReader(bufio.NewReader(strings.NewReader(strings.Repeat("a", 50) + "\r\n.\r\n"))),
+			}
+			proto.t = t
+			proto.ctx = ctx
+			mta.HandleClient(proto)
+		}
+	})
+
+	c.Convey("Testing a too large last chunk of BDAT", t, func(ctx c.C) {
+		cfg := cfg
+		cfg.MaxMessageSize = 30
+		handlers := []Handler{
+			HandlerFunc(func(state *smtp.State) error {
+				return nil
+			}),
+			StreamHandlerFunc(func(ctx context.Context, state *smtp.State, message io.Reader) error {
+				_, err := io.Copy(io.Discard, message)
+				return err
+			}),
+		}
+
+		for _, handler := range handlers {
+			mta := New(cfg, handler)
+			proto := lmtp(
+				smtp.Answer{Status: smtp.AbortMail, EnhancedCode: smtp.EnhancedCode{5, 3, 4}},
+				smtp.Answer{Status: smtp.AbortMail, EnhancedCode: smtp.EnhancedCode{5, 3, 4}},
+				smtp.Answer{Status: smtp.Ok},
+			)
+			// BDAT has no 354 reply, the NOOP checks the session is still in sync.
+			proto.cmds = append(proto.cmds[:6],
+				smtp.BdatCmd{Size: 40, Last: true, R: strings.NewReader(strings.Repeat("a", 40))},
+				smtp.NoopCmd{},
+				smtp.QuitCmd{},
+			)
+			proto.answers = append(proto.answers[:7], proto.answers[8:]...)
+			proto.t = t
+			proto.ctx = ctx
+			mta.HandleClient(proto)
+		}
+	})
+
+	c.Convey("Testing recipient errors in SMTP mode", t, func(ctx c.C) {
+		mta := New(Config{Hostname: "home.sweet.home", DisableAuth: true}, HandlerFunc(func(state *smtp.State) error {
+			return RecipientErrors{nil, smtp.SMTPErrorPermanentExceededStorage}
+		}))
+
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.LhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.HeloCmd{
+					Domain: "some.sender",
+				},
+				smtp.MailCmd{
+					From: getMailWithoutError("someone@somewhere.test"),
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy1@somewhere.test"),
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy2@somewhere.test"),
+				},
+				smtp.DataCmd{
+					R: *smtp.NewDataReader(bufio.NewReader(bytes.NewReader([]byte("Some test email\n.\n")))),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{Status: smtp.Ready},
+				smtp.Answer{Status: smtp.SyntaxError},
+				smtp.Answer{Status: smtp.Ok},
+				smtp.Answer{Status: smtp.Ok},
+				smtp.Answer{Status: smtp.Ok},
+				smtp.Answer{Status: smtp.Ok},
+				smtp.Answer{Status: smtp.StartData},
+				smtp.Answer{Status: smtp.SMTPErrorPermanentExceededStorage.Status},
+				smtp.Answer{Status: smtp.Closing},
+			},
+		}
+		mta.HandleClient(proto)
+	})
+}
+
+// Tests listening on a Unix socket
+func TestUnixSocket(t *testing.T) {
+	c.Convey("Testing listening on a Unix socket", t, func() {
+		socketPath := filepath.Join(t.TempDir(), "lmtp.sock")
+
+		mta := NewDefault(Config{Hostname: "home.sweet.home", LMTP: true, SocketPath: socketPath}, HandlerFunc(dummyHandler))
+		ln, err := mta.newListener()
+		c.So(err, c.ShouldBeNil)
+		defer ln.Close()
+
+		go func() {
+			_ = mta.listen(ln, false)
+		}()
+
+		conn, err := net.Dial("unix", socketPath)
+		c.So(err, c.ShouldBeNil)
+		defer conn.Close()
+
+		greeting, err := bufio.NewReader(conn).ReadString('\n')
+		c.So(err, c.ShouldBeNil)
+		c.So(greeting, c.ShouldEqual, "220 home.sweet.home LMTP Service Ready\r\n")
+	})
+}
+
+// newTestTLSConfig returns a tls.Config with a self-signed certificate.
+func newTestTLSConfig() *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "home.sweet.home"},
+		DNSNames:     []string{"home.sweet.home"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// Tests implicit TLS
+func TestImplicitTLS(t *testing.T) {
+	cfg := Config{
+		Hostname:    "home.sweet.home",
+		DisableAuth: true,
+		TLSConfig:   newTestTLSConfig(),
+	}
+
+	c.Convey("Testing serving with implicit TLS", t, func() {
+		mta := NewDefault(cfg, HandlerFunc(dummyHandler))
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		c.So(err, c.ShouldBeNil)
+		defer ln.Close()
+
+		go func() {
+			_ = mta.ServeTLS(ln)
+		}()
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		c.So(err, c.ShouldBeNil)
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+		line, err := br.ReadString('\n')
+		c.So(err, c.ShouldBeNil)
+		c.So(line, c.ShouldEqual, "220 home.sweet.home Service Ready\r\n")
+
+		_, err = conn.Write([]byte("EHLO some.sender\r\n"))
+		c.So(err, c.ShouldBeNil)
+
+		lines := []string{}
+		for {
+			line, err = br.ReadString('\n')
+			c.So(err, c.ShouldBeNil)
+			lines = append(lines, line)
+			if strings.HasPrefix(line, "250 ") {
+				break
+			}
+		}
+		c.So(lines, c.ShouldNotContain, "250-STARTTLS\r\n")
+		c.So(lines, c.ShouldContain, "250-SIZE\r\n")
+
+		_, err = conn.Write([]byte("STARTTLS\r\n"))
+		c.So(err, c.ShouldBeNil)
+		line, err = br.ReadString('\n')
+		c.So(err, c.ShouldBeNil)
+		c.So(line, c.ShouldStartWith, "502 ")
+	})
+
+	c.Convey("Testing implicit TLS without TLS config", t, func() {
+		mta := NewDefault(Config{Hostname: "home.sweet.home"}, HandlerFunc(dummyHandler))
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		c.So(err, c.ShouldBeNil)
+
+		err = mta.ServeTLS(ln)
+		c.So(err, c.ShouldNotBeNil)
+	})
+}
+
+type testBlacklist struct {
+	ips []string
+}
+
+func (b testBlacklist) CheckIp(ip string) bool {
+	for _, i := range b.ips {
+		if i == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// Tests the XCLIENT and XFORWARD commands
+func TestXclient(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	cfg := Config{
+		Hostname:        "home.sweet.home",
+		DisableAuth:     true,
+		TrustedNetworks: []*net.IPNet{loopback},
+		Blacklist:       testBlacklist{ips: []string{"192.0.2.66"}},
+	}
+
+	var received smtp.State
+	mta := New(cfg, HandlerFunc(func(state *smtp.State) error {
+		received = *state
+		return nil
+	}))
+	if mta == nil {
+		t.Fatal("Could not create mta server")
+	}
+
+	c.Convey("Testing XCLIENT and XFORWARD are only advertised to trusted proxies", t, func() {
+		c.So(mta.extensions(&smtp.State{}, false), c.ShouldNotContain, "XCLIENT NAME ADDR HELO LOGIN")
+		c.So(mta.extensions(&smtp.State{}, true), c.ShouldContain, "XCLIENT NAME ADDR HELO LOGIN")
+		c.So(mta.extensions(&smtp.State{}, true), c.ShouldContain, "XFORWARD NAME ADDR HELO")
+		c.So(mta.isTrustedProxy(net.ParseIP("127.0.0.1")), c.ShouldBeTrue)
+		c.So(mta.isTrustedProxy(net.ParseIP("192.0.2.1")), c.ShouldBeFalse)
+	})
+
+	c.Convey("Testing XCLIENT overrides the client for the rest of the session", t, func(ctx c.C) {
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "proxy.sweet.home",
+				},
+				smtp.XclientCmd{
+					Attributes: map[string]string{
+						"NAME":  "spike.porcupine.org",
+						"ADDR":  "IPV6:2001:db8::1",
+						"HELO":  "spike.porcupine.org",
+						"LOGIN": "someone@somewhere.test",
+					},
+				},
+				smtp.EhloCmd{
+					Domain: "proxy.sweet.home",
+				},
+				smtp.MailCmd{
+					From: getMailWithoutError("someone@somewhere.test"),
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy1@somewhere.test"),
+				},
+				smtp.DataCmd{
+					R: *smtp.NewDataReader(bufio.NewReader(bytes.NewReader([]byte("Some test email\n.\n")))),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.StartData,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+
+		c.So(received.Ip.String(), c.ShouldEqual, "2001:db8::1")
+		c.So(received.ReverseName, c.ShouldEqual, "spike.porcupine.org")
+		c.So(received.Hostname, c.ShouldEqual, "spike.porcupine.org")
+		c.So(received.Authenticated, c.ShouldBeTrue)
+		c.So(received.User.Username(), c.ShouldEqual, "someone@somewhere.test")
+	})
+
+	c.Convey("Testing XFORWARD", t, func(ctx c.C) {
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "proxy.sweet.home",
+				},
+				smtp.XforwardCmd{
+					Attributes: map[string]string{
+						"NAME": "[UNAVAILABLE]",
+						"ADDR": "192.0.2.1",
+					},
+				},
+				smtp.XforwardCmd{
+					Attributes: map[string]string{
+						"LOGIN": "someone@somewhere.test",
+					},
+				},
+				smtp.XforwardCmd{
+					Attributes: map[string]string{
+						"ADDR": "not.an.address",
+					},
+				},
+				smtp.MailCmd{
+					From: getMailWithoutError("someone@somewhere.test"),
+				},
+				smtp.XforwardCmd{
+					Attributes: map[string]string{
+						"ADDR": "192.0.2.2",
+					},
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy1@somewhere.test"),
+				},
+				smtp.DataCmd{
+					R: *smtp.NewDataReader(bufio.NewReader(bytes.NewReader([]byte("Some test email\n.\n")))),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:       smtp.Ok,
+					EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+				},
+				smtp.Answer{
+					Status:       smtp.SyntaxErrorParam,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+				},
+				smtp.Answer{
+					Status:       smtp.SyntaxErrorParam,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:       smtp.BadSequence,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.StartData,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+
+		c.So(received.Ip.String(), c.ShouldEqual, "192.0.2.1")
+		c.So(received.ReverseName, c.ShouldEqual, "")
+		c.So(received.Hostname, c.ShouldEqual, "proxy.sweet.home")
+	})
+
+	c.Convey("Testing XCLIENT with a blacklisted address", t, func(ctx c.C) {
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.XclientCmd{
+					Attributes: map[string]string{
+						"ADDR": "192.0.2.66",
+					},
+				},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status:       smtp.NoValidRecipients,
+					EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				},
+			},
+		}
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing XCLIENT from an untrusted client", t, func(ctx c.C) {
+		untrusted := New(Config{Hostname: "home.sweet.home", DisableAuth: true}, HandlerFunc(dummyHandler))
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.XclientCmd{
+					Attributes: map[string]string{
+						"ADDR": "192.0.2.1",
+					},
+				},
+				smtp.XforwardCmd{
+					Attributes: map[string]string{
+						"ADDR": "192.0.2.1",
+					},
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status:       smtp.MailboxUnavailable,
+					EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+				},
+				smtp.Answer{
+					Status:       smtp.MailboxUnavailable,
+					EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		untrusted.HandleClient(proto)
+
+		c.So(proto.state.Ip.String(), c.ShouldEqual, "127.0.0.1")
+	})
+}
+
+// Tests the PROXY protocol
+func TestProxyProtocol(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	received := make(chan smtp.State, 1)
+	cfg := Config{
+		Hostname:              "home.sweet.home",
+		DisableAuth:           true,
+		ProxyProtocolNetworks: []*net.IPNet{loopback},
+		Blacklist:             testBlacklist{ips: []string{"192.0.2.66"}},
+	}
+	mta := NewDefault(cfg, HandlerFunc(func(state *smtp.State) error {
+		received <- *state
+		return nil
+	}))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		_ = mta.listen(ln, false)
+	}()
+
+	c.Convey("Testing the client address of the PROXY header", t, func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		c.So(err, c.ShouldBeNil)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n"))
+		c.So(err, c.ShouldBeNil)
+
+		br := bufio.NewReader(conn)
+		line, err := br.ReadString('\n')
+		c.So(err, c.ShouldBeNil)
+		c.So(line, c.ShouldEqual, "220 home.sweet.home Service Ready\r\n")
+
+		_, err = conn.Write([]byte("HELO some.sender\r\nMAIL FROM:<someone@somewhere.test>\r\nRCPT TO:<guy1@somewhere.test>\r\nDATA\r\n"))
+		c.So(err, c.ShouldBeNil)
+		for i := 0; i < 4; i++ {
+			_, err = br.ReadString('\n')
+			c.So(err, c.ShouldBeNil)
+		}
+		_, err = conn.Write([]byte("Some test email\r\n.\r\n"))
+		c.So(err, c.ShouldBeNil)
+
+		state := <-received
+		c.So(state.Ip.String(), c.ShouldEqual, "192.0.2.1")
+		c.So(state.Proxy, c.ShouldNotBeNil)
+		c.So(state.Proxy.SourceAddr.Port, c.ShouldEqual, 56324)
+	})
+
+	c.Convey("Testing the blacklist with the address of the PROXY header", t, func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		c.So(err, c.ShouldBeNil)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("PROXY TCP4 192.0.2.66 198.51.100.1 56324 25\r\n"))
+		c.So(err, c.ShouldBeNil)
+
+		_, err = bufio.NewReader(conn).ReadString('\n')
+		c.So(err, c.ShouldNotBeNil)
+	})
+
+	c.Convey("Testing a connection without PROXY header", t, func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		c.So(err, c.ShouldBeNil)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("EHLO some.sender\r\n"))
+		c.So(err, c.ShouldBeNil)
+
+		_, err = bufio.NewReader(conn).ReadString('\n')
+		c.So(err, c.ShouldNotBeNil)
+	})
+}
+
+type testVerifier struct{}
+
+func (v testVerifier) Verify(state *smtp.State, param string) (*smtp.MailAddress, error) {
+	switch param {
+	case "Fred Smith":
+		return &smtp.MailAddress{Name: "Fred Smith", Address: "fred@home.sweet.home"}, nil
+	case "Jones":
+		return nil, ErrMailboxAmbiguous
+	case "bob":
+		return nil, UserNotLocalError{ForwardPath: &smtp.MailAddress{Address: "bob@elsewhere.test"}}
+	case "ghost":
+		// A broken backend which doesn't return an error.
+		return nil, nil
+	default:
+		return nil, ErrMailboxNotFound
+	}
+}
+
+func (v testVerifier) Expand(state *smtp.State, listName string) ([]*smtp.MailAddress, error) {
+	switch listName {
+	case "staff":
+		return []*smtp.MailAddress{{Address: "fred@home.sweet.home"}, {Address: "jones@home.sweet.home"}}, nil
+	case "ghosts":
+		// A broken backend which returns nil members.
+		return []*smtp.MailAddress{nil, {Address: "fred@home.sweet.home"}, nil}, nil
+	case "empty":
+		return []*smtp.MailAddress{nil}, nil
+	default:
+		return nil, ErrMailboxNotFound
+	}
+}
+
+// Tests VRFY and EXPN
+func TestVerify(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	cfg := Config{
+		Hostname:       "home.sweet.home",
+		DisableAuth:    true,
+		VerifyNetworks: []*net.IPNet{loopback},
+	}
+
+	c.Convey("Testing VRFY and EXPN without backend", t, func(ctx c.C) {
+		mta := New(cfg, HandlerFunc(dummyHandler))
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.VrfyCmd{Param: "Fred Smith"},
+				smtp.ExpnCmd{ListName: "staff"},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status: smtp.CannotVerify,
+				},
+				smtp.Answer{
+					Status: smtp.NotImplemented,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing VRFY and EXPN with backend", t, func(ctx c.C) {
+		mta := New(cfg, HandlerFunc(dummyHandler))
+		mta.Verifier = testVerifier{}
+		mta.ListExpander = testVerifier{}
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.VrfyCmd{Param: "Fred Smith"},
+				smtp.VrfyCmd{Param: "bob"},
+				smtp.VrfyCmd{Param: "Jones"},
+				smtp.VrfyCmd{Param: "nobody"},
+				smtp.VrfyCmd{Param: ""},
+				smtp.ExpnCmd{ListName: "staff"},
+				smtp.ExpnCmd{ListName: "nobody"},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status:       smtp.Ok,
+					EnhancedCode: smtp.EnhancedCode{2, 1, 5},
+				},
+				smtp.Answer{
+					Status: smtp.UserNotLocal,
+				},
+				smtp.Answer{
+					Status:       553,
+					EnhancedCode: smtp.EnhancedCode{5, 1, 4},
+				},
+				smtp.Answer{
+					Status:       smtp.MailboxUnavailable,
+					EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+				},
+				smtp.Answer{
+					Status: smtp.SyntaxErrorParam,
+				},
+				smtp.MultiAnswer{
+					Status:   smtp.Ok,
+					Messages: []string{"<fred@home.sweet.home>", "<jones@home.sweet.home>"},
+				},
+				smtp.Answer{
+					Status: smtp.MailboxUnavailable,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing VRFY and EXPN with nil results of the backend", t, func(ctx c.C) {
+		mta := New(cfg, HandlerFunc(dummyHandler))
+		mta.Verifier = testVerifier{}
+		mta.ListExpander = testVerifier{}
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.VrfyCmd{Param: "ghost"},
+				smtp.ExpnCmd{ListName: "ghosts"},
+				smtp.ExpnCmd{ListName: "empty"},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status:       smtp.MailboxUnavailable,
+					EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+				},
+				smtp.MultiAnswer{
+					Status:   smtp.Ok,
+					Messages: []string{"<fred@home.sweet.home>"},
+				},
+				smtp.Answer{
+					Status:       smtp.MailboxUnavailable,
+					EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing VRFY from a client which isn't allowed", t, func(ctx c.C) {
+		mta := New(Config{Hostname: "home.sweet.home", DisableAuth: true}, HandlerFunc(dummyHandler))
+		mta.Verifier = testVerifier{}
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.VrfyCmd{Param: "Fred Smith"},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status: smtp.CannotVerify,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing VRFY from an authenticated client", t, func(ctx c.C) {
+		mta := New(Config{Hostname: "home.sweet.home", VerifyAuthenticated: true}, HandlerFunc(dummyHandler))
+		mta.Verifier = testVerifier{}
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.VrfyCmd{Param: "Fred Smith"},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		proto.state.Authenticated = true
+		mta.HandleClient(proto)
+	})
+}
+
+type testQueueRunner struct {
+	started []string
+}
+
+func (q *testQueueRunner) StartQueue(state *smtp.State, node string) (QueueStatus, int, error) {
+	q.started = append(q.started, node)
+	switch node {
+	case "example.org":
+		return QueueStarted, 0, nil
+	case "empty.example.org":
+		return QueueEmpty, 0, nil
+	case "@example.org":
+		return QueuePending, 0, nil
+	case "#customer":
+		return QueuePending, 3, nil
+	case "down.example.org":
+		return 0, 0, ErrQueueUnavailable
+	default:
+		return 0, 0, ErrNodeNotAllowed
+	}
+}
+
+// Tests ETRN
+func TestEtrn(t *testing.T) {
+	cfg := Config{
+		Hostname:    "home.sweet.home",
+		DisableAuth: true,
+	}
+
+	c.Convey("Testing ETRN without queue runner", t, func(ctx c.C) {
+		mta := New(cfg, HandlerFunc(dummyHandler))
+		c.So(mta.extensions(&smtp.State{}, false), c.ShouldNotContain, "ETRN")
+
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EtrnCmd{Node: "example.org"},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status: smtp.NotImplemented,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing ETRN with queue runner", t, func(ctx c.C) {
+		mta := New(cfg, HandlerFunc(dummyHandler))
+		runner := &testQueueRunner{}
+		mta.QueueRunner = runner
+		c.So(mta.extensions(&smtp.State{}, false), c.ShouldContain, "ETRN")
+
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EtrnCmd{Node: "example.org"},
+				smtp.EtrnCmd{Node: "empty.example.org"},
+				smtp.EtrnCmd{Node: "@example.org"},
+				smtp.EtrnCmd{Node: "#customer"},
+				smtp.EtrnCmd{Node: "down.example.org"},
+				smtp.EtrnCmd{Node: "other.example.org"},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status: smtp.QueuingStarted,
+				},
+				smtp.Answer{
+					Status: smtp.NoMessagesWaiting,
+				},
+				smtp.Answer{
+					Status: smtp.PendingMessagesStarted,
+				},
+				smtp.Answer{
+					Status: smtp.MessagesStarted,
+				},
+				smtp.Answer{
+					Status: smtp.UnableToQueueMessages,
+				},
+				smtp.Answer{
+					Status: smtp.NodeNotAllowed,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+
+		c.So(runner.started, c.ShouldHaveLength, 6)
+	})
+}
+
+// Tests the MT-PRIORITY and BY parameters
+func TestDeliveryParameters(t *testing.T) {
+	cfg := Config{
+		Hostname:         "home.sweet.home",
+		DisableAuth:      true,
+		MinDeliverByTime: time.Minute,
+	}
+
+	var received smtp.State
+	mta := New(cfg, HandlerFunc(func(state *smtp.State) error {
+		received = *state
+		return nil
+	}))
+	if mta == nil {
+		t.Fatal("Could not create mta server")
+	}
+
+	c.Convey("Testing DELIVERBY and MT-PRIORITY are advertised", t, func() {
+		c.So(mta.extensions(&smtp.State{}, false), c.ShouldContain, "DELIVERBY 60")
+		c.So(mta.extensions(&smtp.State{}, false), c.ShouldContain, "MT-PRIORITY")
+	})
+
+	c.Convey("Testing the parameters are kept in the state", t, func(ctx c.C) {
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{
+					Domain: "some.sender",
+				},
+				smtp.MailCmd{
+					From:      getMailWithoutError("someone@somewhere.test"),
+					DeliverBy: &smtp.DeliverBy{Time: 30 * time.Second, Mode: smtp.DeliverByReturn},
+				},
+				smtp.MailCmd{
+					From:      getMailWithoutError("someone@somewhere.test"),
+					Priority:  smtp.MaxPriority,
+					DeliverBy: &smtp.DeliverBy{Time: time.Hour, Mode: smtp.DeliverByReturn},
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy1@somewhere.test"),
+				},
+				smtp.DataCmd{
+					R: *smtp.NewDataReader(bufio.NewReader(bytes.NewReader([]byte("Some test email\n.\n")))),
+				},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:       smtp.SyntaxErrorParam,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.StartData,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+
+		c.So(received.Priority, c.ShouldEqual, smtp.MaxPriority)
+		c.So(received.DeliverBy, c.ShouldNotBeNil)
+		c.So(received.DeliverBy.Deadline, c.ShouldHappenWithin, time.Minute, time.Now().Add(time.Hour))
+	})
+}
+
+// Tests the ContextHandler
+func TestContextHandler(t *testing.T) {
+	cfg := Config{
+		Hostname:       "home.sweet.home",
+		DisableAuth:    true,
+		HandlerTimeout: time.Minute,
+	}
+
+	mailCmds := func() []smtp.Cmd {
+		return []smtp.Cmd{
+			smtp.MailCmd{
+				From: getMailWithoutError("someone@somewhere.test"),
+			},
+			smtp.RcptCmd{
+				To: getMailWithoutError("guy1@somewhere.test"),
+			},
+			smtp.DataCmd{
+				R: *smtp.NewDataReader(bufio.NewReader(bytes.NewReader([]byte("Some test email\n.\n")))),
+			},
+			smtp.QuitCmd{},
+		}
+	}
+
+	c.Convey("Testing the context of a ContextHandler", t, func(ctx c.C) {
+		var sessionId smtp.Id
+		var deadline time.Time
+		mta := New(cfg, ContextHandlerFunc(func(handlerCtx context.Context, state *smtp.State) error {
+			sessionId, _ = SessionIdFromContext(handlerCtx)
+			deadline, _ = handlerCtx.Deadline()
+			return handlerCtx.Err()
+		}))
+
+		proto := &testProtocol{
+			t:    t,
+			ctx:  ctx,
+			cmds: mailCmds(),
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.StartData,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+
+		c.So(sessionId, c.ShouldResemble, proto.state.SessionId)
+		c.So(deadline, c.ShouldHappenWithin, time.Second, time.Now().Add(time.Minute))
+	})
+
+	c.Convey("Testing the context is cancelled when the server stops", t, func(ctx c.C) {
+		started := make(chan bool)
+		mta := New(cfg, ContextHandlerFunc(func(handlerCtx context.Context, state *smtp.State) error {
+			close(started)
+			<-handlerCtx.Done()
+			return handlerCtx.Err()
+		}))
+		go func() {
+			<-started
+			mta.cancel()
+		}()
+
+		proto := &testProtocol{
+			t:    t,
+			ctx:  ctx,
+			cmds: mailCmds(),
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.StartData,
+				},
+				smtp.Answer{
+					Status:       451,
+					EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing a ContextHandlerFunc is a Handler", t, func() {
+		var handler Handler = ContextHandlerFunc(func(handlerCtx context.Context, state *smtp.State) error {
+			return handlerCtx.Err()
+		})
+		c.So(handler.Handle(&smtp.State{}), c.ShouldBeNil)
+	})
+}
+
+type testPolicy struct {
+	connectErr error
+}
+
+func (p testPolicy) CheckConnect(state *smtp.State) error {
+	return p.connectErr
+}
+
+func (p testPolicy) CheckHelo(state *smtp.State, domain string) error {
+	if domain == "localhost" {
+		return smtp.SMTPError{Status: smtp.MailboxUnavailable, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Invalid HELO name"}
+	}
+	return nil
+}
+
+func (p testPolicy) CheckMail(state *smtp.State, cmd smtp.MailCmd) error {
+	if cmd.From.GetDomain() == "spammer.test" {
+		return smtp.SMTPErrorPermanentMailboxNameNotAllowed
+	}
+	if cmd.From.GetDomain() == "unknown.test" {
+		return errors.New("dns lookup failed")
+	}
+	return nil
+}
+
+func (p testPolicy) CheckRcpt(state *smtp.State, cmd smtp.RcptCmd) error {
+	if cmd.To.GetLocal() == "unknown" {
+		return smtp.SMTPErrorPermanentMailboxNotAvailable
+	}
+	return nil
+}
+
+func (p testPolicy) CheckData(state *smtp.State) error {
+	if len(state.To) > 1 {
+		return smtp.SMTPError{Status: 554, EnhancedCode: smtp.EnhancedCode{5, 5, 3}, Message: "Too many recipients"}
+	}
+	return nil
+}
+
+func TestPolicies(t *testing.T) {
+	cfg := Config{
+		Hostname:    "home.sweet.home",
+		DisableAuth: true,
+	}
+
+	newServer := func(policy testPolicy, handled *int) *Server {
+		mta := New(cfg, HandlerFunc(func(state *smtp.State) error {
+			*handled++
+			return nil
+		}))
+		mta.ConnectPolicy = policy
+		mta.HeloPolicy = policy
+		mta.MailPolicy = policy
+		mta.RcptPolicy = policy
+		mta.DataPolicy = policy
+		return mta
+	}
+
+	c.Convey("Testing a rejected connection", t, func(ctx c.C) {
+		handled := 0
+		mta := newServer(testPolicy{connectErr: smtp.SMTPError{Status: 554, Message: "No SMTP service here"}}, &handled)
+		proto := &testProtocol{
+			t:    t,
+			ctx:  ctx,
+			cmds: []smtp.Cmd{},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:       554,
+					EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+				},
+			},
+		}
+		mta.HandleClient(proto)
+	})
+
+	c.Convey("Testing policies of the stages of a session", t, func(ctx c.C) {
+		handled := 0
+		mta := newServer(testPolicy{}, &handled)
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.EhloCmd{Domain: "localhost"},
+				smtp.EhloCmd{Domain: "some.sender"},
+				smtp.MailCmd{From: getMailWithoutError("someone@spammer.test")},
+				smtp.MailCmd{From: getMailWithoutError("someone@unknown.test")},
+				smtp.MailCmd{From: getMailWithoutError("someone@somewhere.test")},
+				smtp.RcptCmd{To: getMailWithoutError("unknown@home.sweet.home")},
+				smtp.RcptCmd{To: getMailWithoutError("guy1@home.sweet.home")},
+				smtp.DataCmd{
+					R: *smtp.NewDataReader(bufio.NewReader(bytes.NewReader([]byte("Some test email\n.\n")))),
+				},
+				smtp.MailCmd{From: getMailWithoutError("someone@somewhere.test")},
+				smtp.RcptCmd{To: getMailWithoutError("guy1@home.sweet.home")},
+				smtp.RcptCmd{To: getMailWithoutError("guy2@home.sweet.home")},
+				smtp.DataCmd{},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status:       smtp.MailboxUnavailable,
+					EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				},
+				smtp.MultiAnswer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:       smtp.SMTPErrorPermanentMailboxNameNotAllowed.Status,
+					EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+				},
+				smtp.Answer{
+					Status:       451,
+					EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:       smtp.MailboxUnavailable,
+					EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.StartData,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:       554,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 3},
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+		c.So(handled, c.ShouldEqual, 1)
+		c.So(proto.state.From, c.ShouldBeNil)
+	})
+
+	c.Convey("Testing the data policy with BDAT", t, func(ctx c.C) {
+		handled := 0
+		mta := newServer(testPolicy{}, &handled)
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.MailCmd{From: getMailWithoutError("someone@somewhere.test")},
+				smtp.RcptCmd{To: getMailWithoutError("guy1@home.sweet.home")},
+				smtp.RcptCmd{To: getMailWithoutError("guy2@home.sweet.home")},
+				smtp.BdatCmd{Size: 4, Last: true, R: bytes.NewReader([]byte("mail"))},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:       554,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 3},
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta.HandleClient(proto)
+		c.So(handled, c.ShouldEqual, 0)
+	})
+}
+
+// waitReader only reads after wait is closed.
+type waitReader struct {
+	wait chan struct{}
+	r    io.Reader
+}
+
+func (r *waitReader) Read(b []byte) (int, error) {
+	select {
+	case <-r.wait:
+		return r.r.Read(b)
+	case <-time.After(time.Second):
+		return 0, errors.New("timeout waiting to read")
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	cfg := Config{
+		Hostname:       "home.sweet.home",
+		DisableAuth:    true,
+		MaxMessageSize: 100,
+	}
+
+	var received []byte
+	var readErr error
+	mta := New(cfg, StreamHandlerFunc(func(ctx context.Context, state *smtp.State, message io.Reader) error {
+		received, readErr = io.ReadAll(message)
+		return readErr
+	}))
+
+	mailCmds := func(data string) []smtp.Cmd {
+		return []smtp.Cmd{
+			smtp.MailCmd{
+				From: getMailWithoutError("someone@somewhere.test"),
+			},
+			smtp.RcptCmd{
+				To: getMailWithoutError("guy1@somewhere.test"),
+			},
+			smtp.DataCmd{
+				R: *smtp.NewDataReader(bufio.NewReader(bytes.NewReader([]byte(data)))),
+			},
+			smtp.QuitCmd{},
+		}
+	}
+
+	mailAnswers := func(answer smtp.Answer) []interface{} {
+		return []interface{}{
+			smtp.Answer{
+				Status:  smtp.Ready,
+				Message: cfg.Hostname + " Service Ready",
+			},
+			smtp.Answer{
+				Status: smtp.Ok,
+			},
+			smtp.Answer{
+				Status: smtp.Ok,
+			},
+			smtp.Answer{
+				Status: smtp.StartData,
+			},
+			answer,
+			smtp.Answer{
+				Status:  smtp.Closing,
+				Message: "Bye!",
+			},
+		}
+	}
+
+	c.Convey("Testing a streamed message", t, func(ctx c.C) {
+		proto := &testProtocol{
+			t:       t,
+			ctx:     ctx,
+			cmds:    mailCmds("Some test email\n..with a dot\n.\n"),
+			answers: mailAnswers(smtp.Answer{Status: smtp.Ok, EnhancedCode: smtp.EnhancedCode{2, 0, 0}}),
+		}
+		mta.HandleClient(proto)
+		c.So(readErr, c.ShouldBeNil)
+		c.So(string(received), c.ShouldEqual, "Some test email\n.with a dot\n")
+	})
+
+	c.Convey("Testing a streamed message which is too large", t, func(ctx c.C) {
+		proto := &testProtocol{
+			t:       t,
+			ctx:     ctx,
+			cmds:    mailCmds(strings.Repeat("Some test email\n", 10) + ".\n"),
+			answers: mailAnswers(smtp.Answer{Status: smtp.AbortMail, EnhancedCode: smtp.EnhancedCode{5, 3, 4}}),
+		}
+		mta.HandleClient(proto)
+		c.So(readErr, c.ShouldEqual, smtp.ErrTooLarge)
+		c.So(len(received), c.ShouldEqual, 100)
+	})
+
+	c.Convey("Testing a streamed message with a line which is too long", t, func(ctx c.C) {
+		longLine := "Some test email\n" + strings.Repeat("x", 1001) + "\nmore\n.\n"
+		handled := false
+		mta := New(Config{Hostname: cfg.Hostname, DisableAuth: true}, StreamHandlerFunc(func(ctx context.Context, state *smtp.State, message io.Reader) error {
+			// The handler doesn't read the message, the error is still found.
+			handled = true
+			return nil
+		}))
+		proto := &testProtocol{
+			t:       t,
+			ctx:     ctx,
+			cmds:    mailCmds(longLine),
+			answers: mailAnswers(smtp.Answer{Status: smtp.SyntaxError, EnhancedCode: smtp.EnhancedCode{5, 5, 2}}),
+		}
+		mta.HandleClient(proto)
+		c.So(handled, c.ShouldBeTrue)
+	})
+
+	c.Convey("Testing a message sent with BDAT to a stream handler", t, func(ctx c.C) {
+		firstChunk := make(chan struct{})
+		proto := &testProtocol{
+			t:   t,
+			ctx: ctx,
+			cmds: []smtp.Cmd{
+				smtp.MailCmd{
+					From: getMailWithoutError("someone@somewhere.test"),
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy1@somewhere.test"),
+				},
+				smtp.BdatCmd{Size: 5, R: bytes.NewReader([]byte("Some "))},
+				// The client only sends the last chunk after the handler read the first one.
+				smtp.BdatCmd{Size: 10, Last: true, R: &waitReader{wait: firstChunk, r: bytes.NewReader([]byte("test email"))}},
+				smtp.QuitCmd{},
+			},
+			answers: []interface{}{
+				smtp.Answer{
+					Status:  smtp.Ready,
+					Message: cfg.Hostname + " Service Ready",
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status: smtp.Ok,
+				},
+				smtp.Answer{
+					Status:  smtp.Closing,
+					Message: "Bye!",
+				},
+			},
+		}
+		mta := New(cfg, StreamHandlerFunc(func(ctx context.Context, state *smtp.State, message io.Reader) error {
+			first := make([]byte, 5)
+			_, readErr = io.ReadFull(message, first)
+			close(firstChunk)
+			if readErr != nil {
+				return readErr
+			}
+			received, readErr = io.ReadAll(message)
+			received = append(first, received...)
+			return readErr
+		}))
+		mta.HandleClient(proto)
+		c.So(readErr, c.ShouldBeNil)
+		c.So(string(received), c.ShouldEqual, "Some test email")
+	})
+
+	c.Convey("Testing an aborted message sent with BDAT to a stream handler", t, func(ctx c.C) {
+		bdatCmds := func(cmds ...smtp.Cmd) []smtp.Cmd {
+			return append([]smtp.Cmd{
+				smtp.MailCmd{
+					From: getMailWithoutError("someone@somewhere.test"),
+				},
+				smtp.RcptCmd{
+					To: getMailWithoutError("guy1@somewhere.test"),
+				},
+				smtp.BdatCmd{Size: 5, R: bytes.NewReader([]byte("Some "))},
+			}, cmds...)
+		}
+		bdatAnswers := func(answers ...interface{}) []interface{} {
+			return append([]interface{}{
+				smtp.Answer{Status: smtp.Ready},
+				smtp.Answer{Status: smtp.Ok},
+				smtp.Answer{Status: smtp.Ok},
+				smtp.Answer{Status: smtp.Ok},
+			}, answers...)
+		}
+
+		c.Convey("by another command", func() {
+			proto := &testProtocol{
+				t:   t,
+				ctx: ctx,
+				cmds: bdatCmds(
+					smtp.NoopCmd{},
+					smtp.RsetCmd{},
+					smtp.BdatCmd{Size: 10, Last: true, R: bytes.NewReader([]byte("test email"))},
+					smtp.QuitCmd{},
+				),
+				answers: bdatAnswers(
+					smtp.Answer{Status: smtp.Ok},
+					smtp.Answer{Status: smtp.Ok},
+					smtp.Answer{Status: smtp.BadSequence},
+					smtp.Answer{Status: smtp.Closing},
+				),
+			}
+			mta.HandleClient(proto)
+			c.So(readErr, c.ShouldEqual, smtp.ErrIncomplete)
+			c.So(string(received), c.ShouldEqual, "Some ")
+		})
+
+		c.Convey("by a chunk which is too large", func() {
+			proto := &testProtocol{
+				t:   t,
+				ctx: ctx,
+				cmds: bdatCmds(
+					smtp.BdatCmd{Size: 100, Last: true, R: bytes.NewReader(bytes.Repeat([]byte("x"), 100))},
+					smtp.QuitCmd{},
+				),
+				answers: bdatAnswers(
+					smtp.Answer{Status: smtp.AbortMail, EnhancedCode: smtp.EnhancedCode{5, 3, 4}},
+					smtp.Answer{Status: smtp.Closing},
+				),
+			}
+			mta.HandleClient(proto)
+			c.So(readErr, c.ShouldEqual, smtp.ErrTooLarge)
+			c.So(string(received), c.ShouldEqual, "Some ")
+		})
+
+		c.Convey("by the end of the session", func() {
+			proto := &testProtocol{
+				t:   t,
+				ctx: ctx,
+				cmds: bdatCmds(
+					smtp.QuitCmd{},
+				),
+				answers: bdatAnswers(
+					smtp.Answer{Status: smtp.Closing},
+				),
+			}
+			mta.HandleClient(proto)
+			c.So(readErr, c.ShouldEqual, smtp.ErrIncomplete)
+		})
+	})
+
+	c.Convey("Testing commands between BDAT chunks with a buffered and a stream handler", t, func(ctx c.C) {
+		handlers := []Handler{
+			HandlerFunc(func(state *smtp.State) error {
+				received = state.Data
+				return nil
+			}),
+			StreamHandlerFunc(func(ctx context.Context, state *smtp.State, message io.Reader) error {
+				received, readErr = io.ReadAll(message)
+				return readErr
+			}),
+		}
+
+		for _, handler := range handlers {
+			received = nil
+			mta := New(cfg, handler)
+			proto := &testProtocol{
+				t:   t,
+				ctx: ctx,
+				cmds: []smtp.Cmd{
+					smtp.MailCmd{
+						From: getMailWithoutError("someone@somewhere.test"),
+					},
+					smtp.RcptCmd{
+						To: getMailWithoutError("guy1@somewhere.test"),
+					},
+					smtp.BdatCmd{Size: 5, R: bytes.NewReader([]byte("Some "))},
+					smtp.MailCmd{
+						From: getMailWithoutError("someone@somewhere.test"),
+					},
+					smtp.RcptCmd{
+						To: getMailWithoutError("guy2@somewhere.test"),
+					},
+					smtp.DataCmd{
+						R: *smtp.NewDataReader(bufio.NewReader(bytes.NewReader([]byte("Some test email\n.\n")))),
+					},
+					smtp.NoopCmd{},
+					smtp.BdatCmd{Size: 10, Last: true, R: bytes.NewReader([]byte("test email"))},
+					smtp.QuitCmd{},
+				},
+				answers: []interface{}{
+					smtp.Answer{Status: smtp.Ready},
+					smtp.Answer{Status: smtp.Ok},
+					smtp.Answer{Status: smtp.Ok},
+					smtp.Answer{Status: smtp.Ok},
+					smtp.Answer{Status: smtp.BadSequence, EnhancedCode: smtp.EnhancedCode{5, 5, 1}},
+					smtp.Answer{Status: smtp.BadSequence, EnhancedCode: smtp.EnhancedCode{5, 5, 1}},
+					smtp.Answer{Status: smtp.BadSequence, EnhancedCode: smtp.EnhancedCode{5, 5, 1}},
+					smtp.Answer{Status: smtp.Ok},
+					smtp.Answer{Status: smtp.Ok, EnhancedCode: smtp.EnhancedCode{2, 0, 0}},
+					smtp.Answer{Status: smtp.Closing},
+				},
+			}
+			mta.HandleClient(proto)
+			c.So(string(received), c.ShouldEqual, "Some test email")
+		}
+	})
+
+	c.Convey("Testing StreamHandlerFunc as a buffered Handler", t, func() {
+		err := mta.MailHandler.Handle(&smtp.State{Data: []byte("Some test email")})
+		c.So(err, c.ShouldBeNil)
+		c.So(string(received), c.ShouldEqual, "Some test email")
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	cfg := Config{
+		Hostname:    "home.sweet.home",
+		DisableAuth: true,
+	}
+
+	// serve starts a server on a new listener and returns a connected client.
+	serve := func(mta *DefaultMta) (net.Conn, *bufio.Reader) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		c.So(err, c.ShouldBeNil)
+		go func() {
+			_ = mta.serveListener(ln, false)
+		}()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		c.So(err, c.ShouldBeNil)
+		br := bufio.NewReader(conn)
+		line, err := br.ReadString('\n')
+		c.So(err, c.ShouldBeNil)
+		c.So(line, c.ShouldEqual, "220 home.sweet.home Service Ready\r\n")
+		return conn, br
+	}
+
+	c.Convey("Testing Shutdown without connections", t, func() {
+		mta := NewDefault(cfg, HandlerFunc(dummyHandler))
+		start := time.Now()
+		c.So(mta.Shutdown(context.Background()), c.ShouldBeNil)
+		c.So(time.Since(start), c.ShouldBeLessThan, time.Second)
+	})
+
+	c.Convey("Testing Shutdown with an idle session", t, func() {
+		mta := NewDefault(cfg, HandlerFunc(dummyHandler))
+		conn, br := serve(mta)
+		defer conn.Close()
+
+		_, err := conn.Write([]byte("HELO some.sender\r\n"))
+		c.So(err, c.ShouldBeNil)
+		_, err = br.ReadString('\n')
+		c.So(err, c.ShouldBeNil)
+
+		c.So(mta.Shutdown(context.Background()), c.ShouldBeNil)
+		line, err := br.ReadString('\n')
+		c.So(err, c.ShouldBeNil)
+		c.So(line, c.ShouldEqual, "421 4.3.2 Server is going down.\r\n")
+	})
+
+	c.Convey("Testing Shutdown with a mail transaction in progress", t, func() {
+		mta := NewDefault(cfg, HandlerFunc(dummyHandler))
+		conn, br := serve(mta)
+		defer conn.Close()
+
+		_, err := conn.Write([]byte("HELO some.sender\r\nMAIL FROM:<someone@somewhere.test>\r\n"))
+		c.So(err, c.ShouldBeNil)
+		for i := 0; i < 2; i++ {
+			_, err = br.ReadString('\n')
+			c.So(err, c.ShouldBeNil)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- mta.Shutdown(context.Background())
+		}()
+
+		_, err = conn.Write([]byte("RCPT TO:<guy1@somewhere.test>\r\nDATA\r\nSome test email\r\n.\r\n"))
+		c.So(err, c.ShouldBeNil)
+		lines := []string{}
+		for i := 0; i < 4; i++ {
+			line, err := br.ReadString('\n')
+			c.So(err, c.ShouldBeNil)
+			lines = append(lines, line)
+		}
+		c.So(lines[2], c.ShouldStartWith, "250 2.0.0")
+		c.So(lines[3], c.ShouldEqual, "421 4.3.2 Server is going down.\r\n")
+		c.So(<-done, c.ShouldBeNil)
+	})
+
+	c.Convey("Testing Shutdown when the context expires", t, func() {
+		mta := NewDefault(cfg, HandlerFunc(dummyHandler))
+		conn, br := serve(mta)
+		defer conn.Close()
+
+		_, err := conn.Write([]byte("HELO some.sender\r\nMAIL FROM:<someone@somewhere.test>\r\nRCPT TO:<guy1@somewhere.test>\r\nDATA\r\n"))
+		c.So(err, c.ShouldBeNil)
+		for i := 0; i < 4; i++ {
+			_, err = br.ReadString('\n')
+			c.So(err, c.ShouldBeNil)
+		}
+
+		// The client never finishes the message.
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		c.So(mta.Shutdown(ctx), c.ShouldResemble, context.DeadlineExceeded)
+
+		_, err = br.ReadString('\n')
+		c.So(err, c.ShouldNotBeNil)
+	})
+}
+
+func TestTimeouts(t *testing.T) {
+	// serve starts a server with the timeouts on a new listener and returns a connected client.
+	serve := func(timeouts Timeouts) (*DefaultMta, net.Conn, *bufio.Reader) {
+		mta := NewDefault(Config{
+			Hostname:    "home.sweet.home",
+			DisableAuth: true,
+			Timeouts:    timeouts,
+		}, HandlerFunc(dummyHandler))
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		c.So(err, c.ShouldBeNil)
+		go func() {
+			_ = mta.serveListener(ln, false)
+		}()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		c.So(err, c.ShouldBeNil)
+		br := bufio.NewReader(conn)
+		line, err := br.ReadString('\n')
+		c.So(err, c.ShouldBeNil)
+		c.So(line, c.ShouldEqual, "220 home.sweet.home Service Ready\r\n")
+		return mta, conn, br
+	}
+
+	// readTimeout reads the 421 reply and checks the connection is closed.
+	readTimeout := func(br *bufio.Reader) {
+		line, err := br.ReadString('\n')
+		c.So(err, c.ShouldBeNil)
+		c.So(line, c.ShouldEqual, "421 4.4.2 Timeout exceeded, closing connection\r\n")
+		_, err = br.ReadString('\n')
+		c.So(err, c.ShouldEqual, io.EOF)
+	}
+
+	c.Convey("Testing the greeting timeout", t, func() {
+		mta, conn, br := serve(Timeouts{Greeting: 50 * time.Millisecond, Mail: time.Minute})
+		defer mta.Stop()
+		defer conn.Close()
+
+		readTimeout(br)
+	})
+
+	c.Convey("Testing the timeouts of a mail transaction", t, func() {
+		mta, conn, br := serve(Timeouts{Greeting: time.Minute, Mail: time.Minute, Rcpt: 50 * time.Millisecond})
+		defer mta.Stop()
+		defer conn.Close()
+
+		_, err := conn.Write([]byte("HELO some.sender\r\nMAIL FROM:<someone@somewhere.test>\r\n"))
+		c.So(err, c.ShouldBeNil)
+		for i := 0; i < 2; i++ {
+			_, err = br.ReadString('\n')
+			c.So(err, c.ShouldBeNil)
+		}
+
+		readTimeout(br)
+	})
+
+	c.Convey("Testing the timeouts of the message data", t, func() {
+		mta, conn, br := serve(Timeouts{DataInitiation: time.Minute, DataBlock: 50 * time.Millisecond})
+		defer mta.Stop()
+		defer conn.Close()
+
+		_, err := conn.Write([]byte("HELO some.sender\r\nMAIL FROM:<someone@somewhere.test>\r\nRCPT TO:<guy1@somewhere.test>\r\nDATA\r\n"))
+		c.So(err, c.ShouldBeNil)
+		for i := 0; i < 4; i++ {
+			_, err = br.ReadString('\n')
+			c.So(err, c.ShouldBeNil)
+		}
+
+		_, err = conn.Write([]byte("Some test "))
+		c.So(err, c.ShouldBeNil)
+
+		readTimeout(br)
+	})
+
+	c.Convey("Testing the maximum session duration", t, func() {
+		mta, conn, br := serve(Timeouts{Session: 200 * time.Millisecond})
+		defer mta.Stop()
+		defer conn.Close()
+
+		// The client keeps the session busy, but it still ends.
+		for {
+			_, err := conn.Write([]byte("NOOP\r\n"))
+			c.So(err, c.ShouldBeNil)
+			line, err := br.ReadString('\n')
+			c.So(err, c.ShouldBeNil)
+			if !strings.HasPrefix(line, "250") {
+				c.So(line, c.ShouldEqual, "421 4.4.2 Timeout exceeded, closing connection\r\n")
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	// listen starts a server with the config on a new listener and returns a connected client which sends nothing.
+	listen := func(cfg Config, implicitTLS bool) (*DefaultMta, net.Conn) {
+		cfg.Hostname = "home.sweet.home"
+		cfg.DisableAuth = true
+		mta := NewDefault(cfg, HandlerFunc(dummyHandler))
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		c.So(err, c.ShouldBeNil)
+		go func() {
+			_ = mta.serveListener(ln, implicitTLS)
+		}()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		c.So(err, c.ShouldBeNil)
+		return mta, conn
+	}
+
+	c.Convey("Testing the timeout of the TLS handshake of implicit TLS", t, func() {
+		mta, conn := listen(Config{
+			TLSConfig: newTestTLSConfig(),
+			Timeouts:  Timeouts{Greeting: time.Minute, Session: 50 * time.Millisecond},
+		}, true)
+		defer mta.Stop()
+		defer conn.Close()
+
+		// The server closes the connection without waiting for the handshake.
+		c.So(conn.SetReadDeadline(time.Now().Add(5*time.Second)), c.ShouldBeNil)
+		_, err := conn.Read(make([]byte, 1))
+		c.So(err, c.ShouldEqual, io.EOF)
+	})
+
+	c.Convey("Testing the timeout of the PROXY header", t, func() {
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		mta, conn := listen(Config{
+			ProxyProtocolNetworks: []*net.IPNet{loopback},
+			Timeouts:              Timeouts{Greeting: 50 * time.Millisecond},
+		}, false)
+		defer mta.Stop()
+		defer conn.Close()
+
+		// Shorter than proxyHeaderTimeout.
+		c.So(conn.SetReadDeadline(time.Now().Add(5*time.Second)), c.ShouldBeNil)
+		_, err := conn.Read(make([]byte, 1))
+		c.So(err, c.ShouldEqual, io.EOF)
+	})
+}
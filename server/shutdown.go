@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// shutdownPollInterval is how often Shutdown checks whether all connections are closed.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown stops the server gracefully, like http.Server.Shutdown.
+// It stops accepting connections and sends 421 to sessions without a mail transaction.
+// Sessions in a mail transaction can finish it and get 421 afterwards.
+// Shutdown returns nil when all connections are closed. If the context expires first,
+// the remaining sessions are stopped, their connections are closed and the error of the context is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Printf("Received shutdown command. Sending shutdown event...")
+	s.shutDownOnce.Do(func() {
+		close(s.shutDownC)
+	})
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.activeConnections() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Printf("Sending force quit event...")
+			s.quit()
+			s.closeConnections()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	s.quit()
+	return nil
+}
+
+// quit stops the remaining sessions and cancels the context of the handlers.
+func (s *Server) quit() {
+	s.quitOnce.Do(func() {
+		close(s.quitC)
+		s.cancel()
+	})
+}
+
+// trackSession counts the sessions of HandleClient.
+func (s *Server) trackSession(add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.sessions++
+	} else {
+		s.sessions--
+	}
+}
+
+// trackConn keeps the connections of a DefaultMta, including the ones which didn't start a session yet.
+func (s *Server) trackConn(c net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	if add {
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+}
+
+func (s *Server) activeConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions + len(s.conns)
+}
+
+// closeConnections closes the connections of a DefaultMta,
+// which stops the sessions that are blocked reading from or writing to the client.
+func (s *Server) closeConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/mistralmail/smtp/smtp"
+)
+
+// StreamHandler is a Handler which reads the message while it is received,
+// instead of getting it in State.Data after the whole message was received.
+// It gets a context like a ContextHandler.
+//
+// The reader returns smtp.ErrTooLarge if the message exceeds Config.MaxMessageSize,
+// smtp.ErrLtl if a line is too long and smtp.ErrIncomplete if the client disconnects.
+// The client then gets an answer for that error, whatever the handler returns.
+// The part of the message the handler didn't read is discarded.
+//
+// A message sent with BDAT is streamed chunk by chunk, the handler already runs while the client
+// sends the next commands and gets a copy of the state. If the mail transaction ends before
+// the last chunk, e.g. with RSET, the reader returns smtp.ErrIncomplete.
+type StreamHandler interface {
+	HandleStream(ctx context.Context, state *smtp.State, message io.Reader) error
+}
+
+// StreamHandlerFunc is a wrapper to allow normal functions to be used as a stream handler.
+// It also implements Handler so it can be passed to New.
+type StreamHandlerFunc func(context.Context, *smtp.State, io.Reader) error
+
+func (h StreamHandlerFunc) HandleStream(ctx context.Context, state *smtp.State, message io.Reader) error {
+	return h(ctx, state, message)
+}
+
+// Handle calls the function with a background context and the message in State.Data.
+func (h StreamHandlerFunc) Handle(state *smtp.State) error {
+	return h(context.Background(), state, bytes.NewReader(state.Data))
+}
+
+// messageReader is the reader passed to a StreamHandler.
+// It keeps the first error of the DataReader, so a message which couldn't be read
+// completely isn't handled as if it was.
+type messageReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *messageReader) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.r.Read(b)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// finish reads the rest of the message untill the end marker and returns the first error.
+func (r *messageReader) finish() error {
+	for {
+		_, err := io.Copy(io.Discard, r.r)
+		if r.err == nil {
+			r.err = err
+		}
+		if err != smtp.ErrLtl {
+			return r.err
+		}
+	}
+}
+
+// handleStream passes the message of the DATA command to the StreamHandler while it is received
+// and sends the answer. It returns true if the connection must be closed.
+func (s *Server) handleStream(ctx context.Context, proto smtp.Protocol, state *smtp.State, r io.Reader) bool {
+	message := &messageReader{r: r}
+	err := s.handle(ctx, proto, state, message)
+
+	if readErr := message.finish(); readErr == smtp.ErrTimeout {
+		proto.Send(timeoutAnswer)
+		return true
+	} else if readErr != nil {
+		s.sendRejectAnswers(proto, state, messageErrorAnswer(readErr), true)
+		return false
+	}
+
+	s.sendMailAnswers(proto, state, err)
+	return false
+}
+
+// messageErrorAnswer returns the answer for an error of the DataReader.
+func messageErrorAnswer(err error) smtp.Answer {
+	switch err {
+	case smtp.ErrTooLarge:
+		return smtp.Answer{
+			Status:       smtp.AbortMail,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+			Message:      "Message size exceeds fixed maximum message size",
+		}
+	case smtp.ErrLtl:
+		return smtp.Answer{
+			Status:       smtp.SyntaxError,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+			Message:      "Line too long",
+		}
+	case smtp.ErrTimeout:
+		return timeoutAnswer
+	default:
+		return smtp.Answer{
+			Status:       smtp.SyntaxError,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+			Message:      "Could not parse mail data",
+		}
+	}
+}
+
+// bdatStream passes the chunks of BDAT commands to a StreamHandler while they are received.
+type bdatStream struct {
+	w      *io.PipeWriter
+	size   int64
+	result chan error
+}
+
+// startBdatStream starts the StreamHandler for the message of the BDAT commands.
+func (s *Server) startBdatStream(ctx context.Context, proto smtp.Protocol, state *smtp.State) *bdatStream {
+	r, w := io.Pipe()
+	stream := &bdatStream{w: w, result: make(chan error, 1)}
+	// The session goes on while the handler runs, it can't share the state.
+	handlerState := *state
+	go func() {
+		err := s.handle(ctx, proto, &handlerState, r)
+		// Discard the part of the message the handler didn't read.
+		_, _ = io.Copy(io.Discard, r)
+		stream.result <- err
+	}()
+	return stream
+}
+
+// write passes a chunk to the handler.
+func (b *bdatStream) write(chunk io.Reader) (int64, error) {
+	n, err := io.Copy(b.w, chunk)
+	b.size += n
+	return n, err
+}
+
+// finish ends the message and returns the error of the handler.
+// The reader of the handler returns err at the end of the message, io.EOF if err is nil.
+func (b *bdatStream) finish(err error) error {
+	_ = b.w.CloseWithError(err)
+	return <-b.result
+}
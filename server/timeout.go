@@ -0,0 +1,128 @@
+package server
+
+import (
+	"io"
+	"time"
+
+	"github.com/mistralmail/smtp/smtp"
+)
+
+// Timeouts are the times the server waits for the client in the stages of a session (RFC 5321 4.5.3.2).
+// When a timeout expires the session ends with a 421 reply. 0 means no timeout.
+// The timeouts only apply to a Protocol which implements smtp.Timeouter.
+type Timeouts struct {
+	// Greeting is the time to send the first command after the greeting.
+	// It is also the time for the PROXY header and the TLS handshake of implicit TLS.
+	Greeting time.Duration
+	// Mail is the time to send a command when there is no mail transaction, e.g. MAIL.
+	Mail time.Duration
+	// Rcpt is the time to send a command in a mail transaction, e.g. RCPT, DATA or BDAT.
+	Rcpt time.Duration
+	// DataInitiation is the time to start sending the message after the 354 reply to DATA.
+	DataInitiation time.Duration
+	// DataBlock is the time to send every next block of the message, and of the chunk of BDAT.
+	DataBlock time.Duration
+	// DataTermination is the time the handler has for a received message, while the client waits for the reply.
+	// It is the deadline of the context of a ContextHandler or StreamHandler, or HandlerTimeout if that is shorter.
+	// It doesn't apply while a message is streamed to a StreamHandler.
+	DataTermination time.Duration
+	// Session is the maximum duration of a session, whatever the client is doing.
+	Session time.Duration
+}
+
+// DefaultTimeouts are the timeouts of RFC 5321 4.5.3.2, without a maximum session duration.
+var DefaultTimeouts = Timeouts{
+	Greeting:        5 * time.Minute,
+	Mail:            5 * time.Minute,
+	Rcpt:            5 * time.Minute,
+	DataInitiation:  2 * time.Minute,
+	DataBlock:       3 * time.Minute,
+	DataTermination: 10 * time.Minute,
+}
+
+var timeoutAnswer = smtp.Answer{
+	Status:       smtp.ShuttingDown,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+	Message:      "Timeout exceeded, closing connection",
+}
+
+// setTimeout sets the timeout of the next reads, if the protocol supports timeouts.
+func setTimeout(proto smtp.Protocol, timeout time.Duration) {
+	if timeouter, ok := proto.(smtp.Timeouter); ok {
+		timeouter.SetTimeout(timeout)
+	}
+}
+
+// setSessionDeadline sets the end of the maximum session duration, if the protocol supports timeouts.
+func (s *Server) setSessionDeadline(proto smtp.Protocol) {
+	timeouter, ok := proto.(smtp.Timeouter)
+	if !ok || s.config.Timeouts.Session == 0 {
+		return
+	}
+	timeouter.SetDeadline(time.Now().Add(s.config.Timeouts.Session))
+}
+
+// connectTimeout returns the time a new connection has for the PROXY header and the TLS handshake
+// of implicit TLS, 0 if there is none. It is the Greeting timeout, but not more than the Session timeout.
+func (s *Server) connectTimeout() time.Duration {
+	timeout := s.config.Timeouts.Greeting
+	session := s.config.Timeouts.Session
+	if session > 0 && (timeout == 0 || session < timeout) {
+		timeout = session
+	}
+	return timeout
+}
+
+// commandTimeout returns the timeout for the next command in the stage of the session.
+func (s *Server) commandTimeout(state *smtp.State) time.Duration {
+	switch {
+	case state.From != nil:
+		return s.config.Timeouts.Rcpt
+	case state.Hostname == "":
+		return s.config.Timeouts.Greeting
+	default:
+		return s.config.Timeouts.Mail
+	}
+}
+
+// handlerTimeout returns the deadline of the context of a handler, 0 if there is none.
+// The message is the reader of a StreamHandler, nil if the message was already received.
+func (s *Server) handlerTimeout(message io.Reader) time.Duration {
+	timeout := s.config.HandlerTimeout
+	termination := s.config.Timeouts.DataTermination
+	if message == nil && termination > 0 && (timeout == 0 || termination < timeout) {
+		timeout = termination
+	}
+	return timeout
+}
+
+// dataReader returns the reader of the message of the DATA command. The client has the
+// DataInitiation timeout to start sending the message and the DataBlock timeout for every next block.
+func (s *Server) dataReader(proto smtp.Protocol, r io.Reader) io.Reader {
+	setTimeout(proto, s.config.Timeouts.DataInitiation)
+	return &dataTimeoutReader{
+		r: r,
+		started: func() {
+			setTimeout(proto, s.config.Timeouts.DataBlock)
+		},
+	}
+}
+
+type dataTimeoutReader struct {
+	r       io.Reader
+	started func()
+}
+
+func (r *dataTimeoutReader) Read(b []byte) (int, error) {
+	if r.started == nil || len(b) == 0 {
+		return r.r.Read(b)
+	}
+
+	// Only wait for the first byte, the rest of the read has the DataBlock timeout.
+	n, err := r.r.Read(b[:1])
+	if n > 0 {
+		r.started()
+		r.started = nil
+	}
+	return n, err
+}
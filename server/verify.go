@@ -0,0 +1,179 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mistralmail/smtp/smtp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Verifier verifies a user name or mailbox for the VRFY command (RFC 5321 3.5.1).
+type Verifier interface {
+	// Verify returns the mailbox of a local user.
+	// It returns ErrMailboxNotFound if there is no such user, ErrMailboxAmbiguous if
+	// more than one user matches and a UserNotLocalError if mail for the user is forwarded.
+	// A nil mailbox without error is handled like ErrMailboxNotFound.
+	Verify(state *smtp.State, param string) (*smtp.MailAddress, error)
+}
+
+// ListExpander expands a mailing list for the EXPN command (RFC 5321 3.5.2).
+type ListExpander interface {
+	// Expand returns the members of the mailing list.
+	// It returns ErrMailboxNotFound if there is no such list. Nil members are skipped.
+	Expand(state *smtp.State, listName string) ([]*smtp.MailAddress, error)
+}
+
+// ErrMailboxNotFound is returned by a Verifier or ListExpander for an unknown user or list
+var ErrMailboxNotFound = errors.New("MailboxNotFoundError")
+
+// ErrMailboxAmbiguous is returned by a Verifier when more than one mailbox matches
+var ErrMailboxAmbiguous = errors.New("MailboxAmbiguousError")
+
+// UserNotLocalError is returned by a Verifier when mail for the user is forwarded to another address.
+type UserNotLocalError struct {
+	ForwardPath *smtp.MailAddress
+}
+
+func (e UserNotLocalError) Error() string {
+	return fmt.Sprintf("user not local, forwarded to %s", e.ForwardPath)
+}
+
+// canVerify returns whether the client is allowed to use VRFY and EXPN.
+func (s *Server) canVerify(state *smtp.State) bool {
+	if s.config.VerifyAuthenticated && state.Authenticated {
+		return true
+	}
+	for _, network := range s.config.VerifyNetworks {
+		if state.Ip != nil && network.Contains(state.Ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleVrfy handles the VRFY command.
+func (s *Server) handleVrfy(proto smtp.Protocol, state *smtp.State, cmd smtp.VrfyCmd) {
+	if s.Verifier == nil || !s.canVerify(state) {
+		/*
+			RFC 5321 7.3
+
+			If a site disables these commands for security reasons, the SMTP
+			server MUST return a 252 response, rather than a code that could be
+			confused with successful or unsuccessful verification.
+		*/
+		proto.Send(smtp.Answer{
+			Status:       smtp.CannotVerify,
+			EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+			Message:      "Cannot VRFY user, but will accept message and attempt delivery",
+		})
+		return
+	}
+
+	if cmd.Param == "" {
+		proto.Send(smtp.Answer{
+			Status:       smtp.SyntaxErrorParam,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+			Message:      "Syntax is VRFY <user name or mailbox>",
+		})
+		return
+	}
+
+	mailbox, err := s.Verifier.Verify(state, cmd.Param)
+	if err == nil && mailbox == nil {
+		err = ErrMailboxNotFound
+	}
+	if err != nil {
+		proto.Send(s.verifyErrorAnswer(state, err))
+		return
+	}
+
+	proto.Send(smtp.Answer{
+		Status:       smtp.Ok,
+		EnhancedCode: smtp.EnhancedCode{2, 1, 5},
+		Message:      mailbox.String(),
+	})
+}
+
+// handleExpn handles the EXPN command.
+func (s *Server) handleExpn(proto smtp.Protocol, state *smtp.State, cmd smtp.ExpnCmd) {
+	if s.ListExpander == nil || !s.canVerify(state) {
+		proto.Send(smtp.Answer{
+			Status:       smtp.NotImplemented,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+			Message:      "Command not implemented",
+		})
+		return
+	}
+
+	if cmd.ListName == "" {
+		proto.Send(smtp.Answer{
+			Status:       smtp.SyntaxErrorParam,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+			Message:      "Syntax is EXPN <mailing list>",
+		})
+		return
+	}
+
+	members, err := s.ListExpander.Expand(state, cmd.ListName)
+
+	// Every member of the list is on a separate line of the reply.
+	messages := []string{}
+	for _, member := range members {
+		if member != nil {
+			messages = append(messages, member.String())
+		}
+	}
+	if err == nil && len(messages) == 0 {
+		err = ErrMailboxNotFound
+	}
+	if err != nil {
+		proto.Send(s.verifyErrorAnswer(state, err))
+		return
+	}
+	proto.Send(smtp.MultiAnswer{
+		Status:       smtp.Ok,
+		EnhancedCode: smtp.EnhancedCode{2, 1, 5},
+		Messages:     messages,
+	})
+}
+
+// verifyErrorAnswer returns the answer for an error of a Verifier or ListExpander.
+func (s *Server) verifyErrorAnswer(state *smtp.State, err error) smtp.Answer {
+	if notLocal, ok := err.(UserNotLocalError); ok {
+		return smtp.Answer{
+			Status:       smtp.UserNotLocal,
+			EnhancedCode: smtp.EnhancedCode{2, 1, 5},
+			Message:      fmt.Sprintf("User not local; will forward to %s", notLocal.ForwardPath),
+		}
+	}
+
+	switch err {
+	case ErrMailboxNotFound:
+		return smtp.Answer{
+			Status:       smtp.MailboxUnavailable,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Mailbox not found",
+		}
+	case ErrMailboxAmbiguous:
+		return smtp.Answer{
+			Status:       smtp.SMTPErrorPermanentMailboxNameNotAllowed.Status,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 4},
+			Message:      "User ambiguous",
+		}
+	}
+
+	if smtpErr, ok := err.(smtp.SMTPError); ok {
+		return smtp.Answer(smtpErr)
+	}
+
+	log.WithFields(log.Fields{
+		"SessionId": state.SessionId.String(),
+		"Ip":        state.Ip.String(),
+	}).Errorf("couldn't verify: %v", err)
+	return smtp.Answer{
+		Status:       smtp.SMTPErrorTransientLocalError.Status,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "local error: something went wrong",
+	}
+}
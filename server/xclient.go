@@ -0,0 +1,183 @@
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/mistralmail/smtp/smtp"
+	log "github.com/sirupsen/logrus"
+)
+
+// The attributes of the Postfix XCLIENT and XFORWARD extensions which are supported,
+// in the order they are advertised in EHLO.
+var (
+	xclientAttributes  = []string{"NAME", "ADDR", "HELO", "LOGIN"}
+	xforwardAttributes = []string{"NAME", "ADDR", "HELO"}
+)
+
+// Attribute values for information that is not known to the proxy.
+const (
+	attributeUnavailable     = "[UNAVAILABLE]"
+	attributeTempUnavailable = "[TEMPUNAVAIL]"
+)
+
+// isTrustedProxy returns whether the ip is in one of the TrustedNetworks.
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.config.TrustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProxyCommand checks whether the XCLIENT or XFORWARD command can be used.
+// It sends the answer and returns false if it can't.
+func (s *Server) checkProxyCommand(proto smtp.Protocol, state *smtp.State, trusted bool, allowed []string, attributes map[string]string) bool {
+	if !trusted {
+		proto.Send(smtp.Answer{
+			Status:       smtp.MailboxUnavailable,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+			Message:      "Insufficient authorization",
+		})
+		return false
+	}
+
+	if state.From != nil {
+		proto.Send(smtp.Answer{
+			Status:       smtp.BadSequence,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+			Message:      "Mail transaction in progress",
+		})
+		return false
+	}
+
+	for name := range attributes {
+		if !containsString(allowed, name) {
+			proto.Send(smtp.Answer{
+				Status:       smtp.SyntaxErrorParam,
+				EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+				Message:      "Bad attribute name: " + name,
+			})
+			return false
+		}
+	}
+
+	if addr, ok := attributes["ADDR"]; ok && !isUnavailable(addr) && parseAttributeAddr(addr) == nil {
+		proto.Send(smtp.Answer{
+			Status:       smtp.SyntaxErrorParam,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+			Message:      "Bad address syntax: " + addr,
+		})
+		return false
+	}
+
+	return true
+}
+
+// handleXclient handles the XCLIENT command, which overrides the client attributes
+// for the rest of the session as if the client connected directly.
+// It returns true if the connection must be closed.
+func (s *Server) handleXclient(proto smtp.Protocol, state *smtp.State, cmd smtp.XclientCmd) bool {
+	s.applyClientAttributes(state, cmd.Attributes)
+
+	if login, ok := cmd.Attributes["LOGIN"]; ok {
+		if isUnavailable(login) {
+			state.Authenticated = false
+			state.User = nil
+		} else {
+			state.Authenticated = true
+			state.User = &SMTPUser{username: login}
+		}
+	}
+
+	if s.isBlacklisted(state) {
+		proto.Send(smtp.Answer{
+			Status:       smtp.NoValidRecipients,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Client host rejected",
+		})
+		return true
+	}
+	if err := s.checkConnect(state); err != nil {
+		proto.Send(s.policyAnswer(state, err))
+		return true
+	}
+
+	// The session starts over, the proxy has to send EHLO again.
+	state.Reset()
+	proto.Send(s.greeting())
+	return false
+}
+
+// handleXforward handles the XFORWARD command, which overrides the client attributes
+// for the rest of the session.
+func (s *Server) handleXforward(proto smtp.Protocol, state *smtp.State, cmd smtp.XforwardCmd) {
+	s.applyClientAttributes(state, cmd.Attributes)
+
+	proto.Send(smtp.Answer{
+		Status:       smtp.Ok,
+		EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+		Message:      "Ok",
+	})
+}
+
+// applyClientAttributes sets the NAME, ADDR and HELO attributes on the state.
+func (s *Server) applyClientAttributes(state *smtp.State, attributes map[string]string) {
+	proxyIp := state.Ip
+
+	if addr, ok := attributes["ADDR"]; ok {
+		state.Ip = parseAttributeAddr(addr)
+	}
+	if name, ok := attributes["NAME"]; ok {
+		state.ReverseName = name
+		if isUnavailable(name) {
+			state.ReverseName = ""
+		}
+	}
+	if helo, ok := attributes["HELO"]; ok {
+		state.Hostname = helo
+		if isUnavailable(helo) {
+			state.Hostname = ""
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"SessionId": state.SessionId.String(),
+		"Ip":        state.Ip.String(),
+		"ProxyIp":   proxyIp.String(),
+	}).Debug("Client attributes set by proxy")
+}
+
+// parseAttributeAddr parses an IPv4 or IPv6 address, IPv6 addresses have an "IPV6:" prefix.
+// It returns nil if the address is unavailable or invalid.
+func parseAttributeAddr(addr string) net.IP {
+	if len(addr) > 5 && strings.EqualFold(addr[:5], "IPV6:") {
+		ip := net.ParseIP(addr[5:])
+		if ip == nil || ip.To4() != nil {
+			return nil
+		}
+		return ip
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() == nil {
+		return nil
+	}
+	return ip
+}
+
+func isUnavailable(value string) bool {
+	return value == attributeUnavailable || value == attributeTempUnavailable
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -2,8 +2,12 @@ package smtp
 
 import (
 	"errors"
+	"fmt"
 	"net/mail"
 	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
 )
 
 type MailAddress mail.Address
@@ -22,6 +26,55 @@ func (address *MailAddress) GetDomain() string {
 	return domain
 }
 
+// GetDomainASCII gets the domain part of a mail address in its ASCII (A-label) form.
+// E.g. "xn--fsqu00a.xn--4rr70v" for "例子.广告".
+func (address *MailAddress) GetDomainASCII() (string, error) {
+	domain := address.GetDomain()
+	if isASCII(domain) {
+		return domain, nil
+	}
+	return idna.Lookup.ToASCII(domain)
+}
+
+// GetDomainUnicode gets the domain part of a mail address in its Unicode (U-label) form.
+// E.g. "例子.广告" for "xn--fsqu00a.xn--4rr70v".
+func (address *MailAddress) GetDomainUnicode() (string, error) {
+	domain := address.GetDomain()
+	if !strings.Contains(strings.ToLower(domain), "xn--") {
+		return domain, nil
+	}
+	return idna.Lookup.ToUnicode(domain)
+}
+
+// NormalizeDomain converts an internationalized domain of the mail address to its ASCII (A-label) form,
+// so a domain is the same string whichever form the client used. E.g. "用户@例子.广告" becomes
+// "用户@xn--fsqu00a.xn--4rr70v". An invalid domain, which ParseAddress doesn't accept, is left unchanged.
+func (address *MailAddress) NormalizeDomain() {
+	if !strings.Contains(address.Address, "@") {
+		return
+	}
+	domain, err := address.GetDomainASCII()
+	if err != nil {
+		return
+	}
+	address.Address = address.GetLocal() + "@" + domain
+}
+
+// IsASCII returns whether the mail address only contains ASCII characters.
+// Addresses which are not ASCII can only be used in a SMTPUTF8 transaction (RFC 6531).
+func (address *MailAddress) IsASCII() bool {
+	return isASCII(address.Address)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
 // GetAddress gets the full mail address.
 func (address *MailAddress) GetAddress() string {
 	return address.Address
@@ -66,5 +119,19 @@ func ParseAddress(rawAddress string) (MailAddress, error) {
 		return MailAddress{}, err
 	}
 
-	return MailAddress(*address), nil
+	/*
+		RFC 6531 3.3
+
+		The domain can be an internationalized domain name, it must be valid
+		in both its U-label and A-label form.
+	*/
+	parsed := MailAddress(*address)
+	if _, err := parsed.GetDomainASCII(); err != nil {
+		return MailAddress{}, fmt.Errorf("invalid domain: %v", err)
+	}
+	if _, err := parsed.GetDomainUnicode(); err != nil {
+		return MailAddress{}, fmt.Errorf("invalid domain: %v", err)
+	}
+
+	return parsed, nil
 }
@@ -90,6 +90,57 @@ func TestParseAddress(t *testing.T) {
 			_, err := ParseAddress("some mail address without at sign")
 			So(err, ShouldNotEqual, nil)
 
+			_, err = ParseAddress("<bob@xn--a.example>")
+			So(err, ShouldNotEqual, nil)
+
+		})
+
+		Convey("Testing ParseAddress() with internationalized mail", func() {
+
+			address, err := ParseAddress("<用户@例子.广告>")
+			So(err, ShouldEqual, nil)
+			So(address.GetLocal(), ShouldEqual, "用户")
+			So(address.GetDomain(), ShouldEqual, "例子.广告")
+			So(address.IsASCII(), ShouldBeFalse)
+
+			domain, err := address.GetDomainASCII()
+			So(err, ShouldEqual, nil)
+			So(domain, ShouldEqual, "xn--fsqu00a.xn--4rr70v")
+
+			domain, err = address.GetDomainUnicode()
+			So(err, ShouldEqual, nil)
+			So(domain, ShouldEqual, "例子.广告")
+
+			address, err = ParseAddress("<bob@xn--fsqu00a.xn--4rr70v>")
+			So(err, ShouldEqual, nil)
+			So(address.IsASCII(), ShouldBeTrue)
+
+			domain, err = address.GetDomainUnicode()
+			So(err, ShouldEqual, nil)
+			So(domain, ShouldEqual, "例子.广告")
+
+			domain, err = address.GetDomainASCII()
+			So(err, ShouldEqual, nil)
+			So(domain, ShouldEqual, "xn--fsqu00a.xn--4rr70v")
+
+		})
+
+		Convey("Testing NormalizeDomain()", func() {
+
+			address, err := ParseAddress("<用户@例子.广告>")
+			So(err, ShouldEqual, nil)
+			address.NormalizeDomain()
+			So(address.Address, ShouldEqual, "用户@xn--fsqu00a.xn--4rr70v")
+
+			address, err = ParseAddress("<bob@xn--fsqu00a.xn--4rr70v>")
+			So(err, ShouldEqual, nil)
+			address.NormalizeDomain()
+			So(address.Address, ShouldEqual, "bob@xn--fsqu00a.xn--4rr70v")
+
+			address = MailAddress{Address: "postmaster"}
+			address.NormalizeDomain()
+			So(address.Address, ShouldEqual, "postmaster")
+
 		})
 
 	})
@@ -84,3 +84,69 @@ func TestDataReaderTooLong(t *testing.T) {
 	data = []byte("Some text :)\naafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddd321\n")
 	expectError(t, data, ErrLtl)
 }
+
+func TestDataReaderMaxSize(t *testing.T) {
+	data := []byte("Some test mail\nblablabla\n.\n")
+	br := bufio.NewReader(bytes.NewReader(data))
+	dataReader := NewDataReader(br)
+	dataReader.SetMaxSize(int64(len("Some test mail\nblablabla\n")))
+	output, err := io.ReadAll(dataReader)
+	if err != nil {
+		t.Errorf("Did not expect error: %v", err)
+	}
+	if !bytes.Equal(output, []byte("Some test mail\nblablabla\n")) {
+		t.Errorf("Expected full message, got %q", output)
+	}
+
+	// Message is too large, rest of the message should be discarded.
+	data = []byte("Some test mail\nblablabla\n.\nQUIT\n")
+	br = bufio.NewReader(bytes.NewReader(data))
+	dataReader = NewDataReader(br)
+	dataReader.SetMaxSize(10)
+	output, err = io.ReadAll(dataReader)
+	if err != ErrTooLarge {
+		t.Errorf("Expected error: %v, got: %v", ErrTooLarge, err)
+	}
+	if len(output) > 10 {
+		t.Errorf("Expected at most 10 bytes, got %d", len(output))
+	}
+	rest, _ := io.ReadAll(br)
+	if !bytes.Equal(rest, []byte("QUIT\n")) {
+		t.Errorf("Expected the data after the message to be left untouched, got %q", rest)
+	}
+
+	// Connection closed while discarding
+	data = []byte("Some test mail\nblablabla\n")
+	dataReader = NewDataReader(bufio.NewReader(bytes.NewReader(data)))
+	dataReader.SetMaxSize(10)
+	_, err = io.ReadAll(dataReader)
+	if err != ErrIncomplete {
+		t.Errorf("Expected error: %v, got: %v", ErrIncomplete, err)
+	}
+}
+
+func TestDataReaderMaxSizeCRLF(t *testing.T) {
+	// The size is counted as sent, a CRLF is 2 octets although it is returned as \n.
+	data := []byte("\r\n\r\n\r\n\r\n\r\n\r\n\r\n\r\n\r\n\r\n.\r\n")
+	dataReader := NewDataReader(bufio.NewReader(bytes.NewReader(data)))
+	dataReader.SetMaxSize(10)
+	output, err := io.ReadAll(dataReader)
+	if err != ErrTooLarge {
+		t.Errorf("Expected error: %v, got: %v", ErrTooLarge, err)
+	}
+	if len(output) > 5 {
+		t.Errorf("Expected at most 5 lines, got %d", len(output))
+	}
+
+	// Dots added for transparency and the end marker don't count.
+	data = []byte("..\r\nabcd\r\n.\r\n")
+	dataReader = NewDataReader(bufio.NewReader(bytes.NewReader(data)))
+	dataReader.SetMaxSize(9)
+	output, err = io.ReadAll(dataReader)
+	if err != nil {
+		t.Errorf("Did not expect error: %v", err)
+	}
+	if !bytes.Equal(output, []byte(".\nabcd\n")) {
+		t.Errorf("Expected full message, got %q", output)
+	}
+}
@@ -0,0 +1,69 @@
+package smtp
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeliverByMode is what should happen when a message can't be delivered within the
+// by-time of the BY parameter (RFC 2852 4).
+type DeliverByMode string
+
+const (
+	// DeliverByNotify means a delay DSN should be sent and delivery continues.
+	DeliverByNotify DeliverByMode = "N"
+	// DeliverByReturn means the message should be returned as undeliverable.
+	DeliverByReturn DeliverByMode = "R"
+)
+
+// DeliverBy is the BY parameter of the MAIL command (RFC 2852).
+type DeliverBy struct {
+	// Time is the by-time, the time within which the message should be delivered.
+	// It can be zero or negative with DeliverByNotify.
+	Time time.Duration
+	Mode DeliverByMode
+	// Trace is set when delivery status should be traced in DSNs.
+	Trace bool
+	// Deadline is the time the message should be delivered by. It is set by the server
+	// when the MAIL command is received, a relay should pass the remaining time on.
+	Deadline time.Time
+}
+
+// parseDeliverBy parses the value of a BY parameter.
+func parseDeliverBy(value string) (*DeliverBy, error) {
+	// The value is by-time ";" by-mode [ "T" ], where by-time is a number of seconds
+	// of at most 9 digits with an optional sign and by-mode is "N" or "R".
+	index := strings.Index(value, ";")
+	if index == -1 {
+		return nil, errors.New("Syntax is BY=<seconds>;N|R[T]")
+	}
+	byTime, byMode := value[:index], strings.ToUpper(value[index+1:])
+
+	digits := strings.TrimLeft(byTime, "+-")
+	if len(digits) == 0 || len(digits) > 9 || len(byTime)-len(digits) > 1 {
+		return nil, errors.New("Syntax is BY=<seconds>;N|R[T]")
+	}
+	seconds, err := strconv.ParseInt(byTime, 10, 64)
+	if err != nil {
+		return nil, errors.New("Syntax is BY=<seconds>;N|R[T]")
+	}
+
+	deliverBy := &DeliverBy{Time: time.Duration(seconds) * time.Second}
+	if strings.HasSuffix(byMode, "T") {
+		deliverBy.Trace = true
+		byMode = byMode[:len(byMode)-1]
+	}
+	deliverBy.Mode = DeliverByMode(byMode)
+	if deliverBy.Mode != DeliverByNotify && deliverBy.Mode != DeliverByReturn {
+		return nil, errors.New("Syntax is BY=<seconds>;N|R[T]")
+	}
+
+	// With the return mode the message can only be delivered if the by-time is positive.
+	if deliverBy.Mode == DeliverByReturn && seconds <= 0 {
+		return nil, errors.New("BY time must be positive with mode R")
+	}
+
+	return deliverBy, nil
+}
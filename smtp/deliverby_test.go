@@ -0,0 +1,30 @@
+package smtp
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDeliverBy(t *testing.T) {
+
+	Convey("Testing parseDeliverBy()", t, func() {
+		deliverBy, err := parseDeliverBy("3600;R")
+		So(err, ShouldBeNil)
+		So(deliverBy, ShouldResemble, &DeliverBy{Time: time.Hour, Mode: DeliverByReturn})
+
+		deliverBy, err = parseDeliverBy("-60;nt")
+		So(err, ShouldBeNil)
+		So(deliverBy, ShouldResemble, &DeliverBy{Time: -time.Minute, Mode: DeliverByNotify, Trace: true})
+
+		deliverBy, err = parseDeliverBy("+999999999;N")
+		So(err, ShouldBeNil)
+		So(deliverBy.Time, ShouldEqual, 999999999*time.Second)
+
+		for _, value := range []string{"", "60", "60;", "60;X", "60;RR", ";R", "1000000000;N", "+-1;N", "0;R", "-5;R", "a;N"} {
+			_, err := parseDeliverBy(value)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
@@ -0,0 +1,185 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DSNReturn is the RET parameter of the MAIL command (RFC 3461 4.3).
+// It specifies whether the full message or only the headers should be returned in a DSN.
+type DSNReturn string
+
+const (
+	DSNReturnFull    DSNReturn = "FULL"
+	DSNReturnHeaders DSNReturn = "HDRS"
+)
+
+// DSNNotify is the NOTIFY parameter of the RCPT command (RFC 3461 4.1).
+// It is a set of conditions under which a DSN should be generated. The zero value means
+// the client didn't specify the parameter.
+type DSNNotify uint8
+
+const (
+	DSNNotifyNever DSNNotify = 1 << iota
+	DSNNotifySuccess
+	DSNNotifyFailure
+	DSNNotifyDelay
+)
+
+// Has returns whether the given condition is set.
+func (n DSNNotify) Has(condition DSNNotify) bool {
+	return n&condition != 0
+}
+
+func (n DSNNotify) String() string {
+	if n == 0 {
+		return ""
+	}
+	if n.Has(DSNNotifyNever) {
+		return "NEVER"
+	}
+
+	conditions := []string{}
+	if n.Has(DSNNotifySuccess) {
+		conditions = append(conditions, "SUCCESS")
+	}
+	if n.Has(DSNNotifyFailure) {
+		conditions = append(conditions, "FAILURE")
+	}
+	if n.Has(DSNNotifyDelay) {
+		conditions = append(conditions, "DELAY")
+	}
+	return strings.Join(conditions, ",")
+}
+
+// OriginalRecipient is the ORCPT parameter of the RCPT command (RFC 3461 4.2).
+type OriginalRecipient struct {
+	// AddressType is the type of the address, e.g. "rfc822".
+	AddressType string
+	// Address is the xtext decoded original recipient address.
+	Address string
+}
+
+// Recipient is a recipient of a mail transaction together with its DSN parameters.
+type Recipient struct {
+	*MailAddress
+	Notify            DSNNotify
+	OriginalRecipient *OriginalRecipient
+}
+
+// parseDSNReturn parses the value of a RET parameter.
+func parseDSNReturn(value string) (DSNReturn, error) {
+	ret := DSNReturn(strings.ToUpper(value))
+	if ret != DSNReturnFull && ret != DSNReturnHeaders {
+		return "", errors.New("Syntax is RET=FULL|HDRS")
+	}
+	return ret, nil
+}
+
+// parseDSNNotify parses the value of a NOTIFY parameter.
+func parseDSNNotify(value string) (DSNNotify, error) {
+	/*
+		RFC 3461 4.1
+
+		notify-esmtp-value  = "NEVER" / 1#notify-list-element
+		notify-list-element = "SUCCESS" / "FAILURE" / "DELAY"
+	*/
+	var notify DSNNotify
+	for _, condition := range strings.Split(strings.ToUpper(value), ",") {
+		switch condition {
+		case "NEVER":
+			notify |= DSNNotifyNever
+		case "SUCCESS":
+			notify |= DSNNotifySuccess
+		case "FAILURE":
+			notify |= DSNNotifyFailure
+		case "DELAY":
+			notify |= DSNNotifyDelay
+		default:
+			return 0, errors.New("Syntax is NOTIFY=NEVER|SUCCESS,FAILURE,DELAY")
+		}
+	}
+
+	if notify.Has(DSNNotifyNever) && notify != DSNNotifyNever {
+		return 0, errors.New("NOTIFY=NEVER can't be combined with other values")
+	}
+
+	return notify, nil
+}
+
+// parseOriginalRecipient parses the value of an ORCPT parameter.
+func parseOriginalRecipient(value string) (*OriginalRecipient, error) {
+	/*
+		RFC 3461 4.2
+
+		orcpt-parameter = "ORCPT=" original-recipient-address
+		original-recipient-address = addr-type ";" xtext
+	*/
+	index := strings.Index(value, ";")
+	if index <= 0 {
+		return nil, errors.New("Syntax is ORCPT=addr-type;xtext")
+	}
+
+	address, err := DecodeXtext(value[index+1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(address) == 0 {
+		return nil, errors.New("Syntax is ORCPT=addr-type;xtext")
+	}
+
+	return &OriginalRecipient{
+		AddressType: value[:index],
+		Address:     address,
+	}, nil
+}
+
+// DecodeXtext decodes an xtext encoded string (RFC 3461 4).
+func DecodeXtext(xtext string) (string, error) {
+	/*
+		RFC 3461 4
+
+		xtext = *( xchar / hexchar )
+		xchar = any ASCII CHAR between "!" (33) and "~" (126) inclusive,
+		        except for "+" and "=".
+		hexchar = ASCII "+" immediately followed by two upper case
+		          hexadecimal digits
+	*/
+	decoded := strings.Builder{}
+	for i := 0; i < len(xtext); i++ {
+		c := xtext[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(xtext) || strings.ToUpper(xtext[i+1:i+3]) != xtext[i+1:i+3] {
+				return "", fmt.Errorf("invalid xtext: %q", xtext)
+			}
+			b, err := strconv.ParseUint(xtext[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid xtext: %q", xtext)
+			}
+			decoded.WriteByte(byte(b))
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", fmt.Errorf("invalid xtext: %q", xtext)
+		default:
+			decoded.WriteByte(c)
+		}
+	}
+	return decoded.String(), nil
+}
+
+// EncodeXtext encodes a string as xtext (RFC 3461 4).
+func EncodeXtext(s string) string {
+	encoded := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&encoded, "+%02X", c)
+			continue
+		}
+		encoded.WriteByte(c)
+	}
+	return encoded.String()
+}
@@ -0,0 +1,69 @@
+package smtp
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDSN(t *testing.T) {
+
+	Convey("Testing DecodeXtext() and EncodeXtext()", t, func() {
+
+		tests := []struct {
+			xtext   string
+			decoded string
+		}{
+			{xtext: "QQ314159", decoded: "QQ314159"},
+			{xtext: "bob+2Bmail@example.com", decoded: "bob+mail@example.com"},
+			{xtext: "a+20b+3Dc", decoded: "a b=c"},
+			{xtext: "", decoded: ""},
+		}
+
+		for _, test := range tests {
+			decoded, err := DecodeXtext(test.xtext)
+			So(err, ShouldEqual, nil)
+			So(decoded, ShouldEqual, test.decoded)
+			So(EncodeXtext(decoded), ShouldEqual, test.xtext)
+		}
+
+		for _, invalid := range []string{"a+2", "a+2b", "a+ZZ", "a=b", "a b", "+"} {
+			_, err := DecodeXtext(invalid)
+			So(err, ShouldBeError)
+		}
+	})
+
+	Convey("Testing parseDSNNotify()", t, func() {
+
+		notify, err := parseDSNNotify("NEVER")
+		So(err, ShouldEqual, nil)
+		So(notify, ShouldEqual, DSNNotifyNever)
+		So(notify.String(), ShouldEqual, "NEVER")
+
+		notify, err = parseDSNNotify("success,Delay")
+		So(err, ShouldEqual, nil)
+		So(notify.Has(DSNNotifySuccess), ShouldBeTrue)
+		So(notify.Has(DSNNotifyDelay), ShouldBeTrue)
+		So(notify.Has(DSNNotifyFailure), ShouldBeFalse)
+		So(notify.String(), ShouldEqual, "SUCCESS,DELAY")
+
+		_, err = parseDSNNotify("NEVER,SUCCESS")
+		So(err, ShouldBeError)
+
+		_, err = parseDSNNotify("SOMETIMES")
+		So(err, ShouldBeError)
+	})
+
+	Convey("Testing parseOriginalRecipient()", t, func() {
+
+		orcpt, err := parseOriginalRecipient("rfc822;bob+2Bmail@example.com")
+		So(err, ShouldEqual, nil)
+		So(orcpt.AddressType, ShouldEqual, "rfc822")
+		So(orcpt.Address, ShouldEqual, "bob+mail@example.com")
+
+		for _, invalid := range []string{"rfc822", ";bob@example.com", "rfc822;", "rfc822;a+ZZ"} {
+			_, err := parseOriginalRecipient(invalid)
+			So(err, ShouldBeError)
+		}
+	})
+}
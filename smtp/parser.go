@@ -6,6 +6,8 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
 )
 
@@ -26,10 +28,11 @@ func (p *parser) ParseCommand(br *bufio.Reader) (command Cmd, err error) {
 	*/
 
 	var address *MailAddress
-	verb, args, err := parseLine(br)
+	verb, params, err := parseVerbLine(br)
 	if err != nil {
 		return nil, err
 	}
+	args := parseArgs(params)
 	//conn.write(500, err.Error())
 	//conn.c.Close()
 
@@ -61,6 +64,19 @@ func (p *parser) ParseCommand(br *bufio.Reader) (command Cmd, err error) {
 			command = EhloCmd{Domain: domain}
 		}
 
+	case "LHLO":
+		{
+			if len(args) != 1 {
+				command = InvalidCmd{Cmd: "LHLO", Info: "LHLO requires exactly one valid domain"}
+				break
+			}
+			domain := ""
+			for _, arg := range args {
+				domain = arg.Key
+			}
+			command = LhloCmd{Domain: domain}
+		}
+
 	case "MAIL":
 		{
 			fromArg := args["FROM"]
@@ -72,20 +88,132 @@ func (p *parser) ParseCommand(br *bufio.Reader) (command Cmd, err error) {
 			}
 
 			eightBitMIME := false
+			binaryMIME := false
 			bodyArg, ok := args["BODY"]
 			if ok {
 				bodyArg.Value = strings.ToUpper(bodyArg.Value)
-				if bodyArg.Operator != "=" || (bodyArg.Value != "8BITMIME" && bodyArg.Value != "7BIT") {
-					command = InvalidCmd{Cmd: verb, Info: "Syntax is BODY=8BITMIME|7BIT"}
+				if bodyArg.Operator != "=" || (bodyArg.Value != "8BITMIME" && bodyArg.Value != "7BIT" && bodyArg.Value != "BINARYMIME") {
+					command = InvalidCmd{Cmd: verb, Info: "Syntax is BODY=8BITMIME|7BIT|BINARYMIME"}
 					break
 				}
 
 				if bodyArg.Value == "8BITMIME" {
 					eightBitMIME = true
 				}
+				if bodyArg.Value == "BINARYMIME" {
+					binaryMIME = true
+				}
 			}
 
-			command = MailCmd{From: address, EightBitMIME: eightBitMIME}
+			/*
+				RFC 1870 6.
+
+				The optional parameter to the MAIL FROM command is "SIZE=" followed
+				by the estimated message size in octets.
+			*/
+			var size int64
+			sizeArg, ok := args["SIZE"]
+			if ok {
+				size, err = strconv.ParseInt(sizeArg.Value, 10, 64)
+				if sizeArg.Operator != "=" || err != nil || size < 0 {
+					command = InvalidCmd{Cmd: verb, Info: "Syntax is SIZE=<size>"}
+					err = nil
+					break
+				}
+			}
+
+			/*
+				RFC 6531 3.4
+
+				The parameter does not accept a value.
+			*/
+			smtpUTF8 := false
+			smtpUTF8Arg, ok := args["SMTPUTF8"]
+			if ok {
+				if smtpUTF8Arg.Operator != "" {
+					command = InvalidCmd{Cmd: verb, Info: "SMTPUTF8 does not accept a value"}
+					break
+				}
+				smtpUTF8 = true
+			}
+
+			/*
+				RFC 3461 4.3 and 4.4
+
+				ret-value = "FULL" / "HDRS"
+				envid-value = xtext
+			*/
+			var ret DSNReturn
+			retArg, ok := args["RET"]
+			if ok {
+				ret, err = parseDSNReturn(retArg.Value)
+				if retArg.Operator != "=" || err != nil {
+					command = InvalidCmd{Cmd: verb, Info: "Syntax is RET=FULL|HDRS"}
+					err = nil
+					break
+				}
+			}
+
+			envelopeId := ""
+			envIdArg, ok := args["ENVID"]
+			if ok {
+				envelopeId, err = DecodeXtext(envIdArg.Value)
+				if envIdArg.Operator != "=" || err != nil || len(envIdArg.Value) == 0 || len(envIdArg.Value) > 100 {
+					command = InvalidCmd{Cmd: verb, Info: "Syntax is ENVID=xtext"}
+					err = nil
+					break
+				}
+			}
+
+			// REQUIRETLS (RFC 8689) is a MAIL parameter without a value.
+			requireTLS := false
+			requireTLSArg, ok := args["REQUIRETLS"]
+			if ok {
+				if requireTLSArg.Operator != "" {
+					command = InvalidCmd{Cmd: verb, Info: "REQUIRETLS does not accept a value"}
+					break
+				}
+				requireTLS = true
+			}
+
+			var priority Priority
+			priorityArg, ok := args["MT-PRIORITY"]
+			if ok {
+				priority, err = parsePriority(priorityArg.Value)
+				if priorityArg.Operator != "=" || err != nil {
+					command = InvalidCmd{Cmd: verb, Info: "Syntax is MT-PRIORITY=[-|+]0-9"}
+					err = nil
+					break
+				}
+			}
+
+			var deliverBy *DeliverBy
+			byArg, ok := args["BY"]
+			if ok {
+				deliverBy, err = parseDeliverBy(byArg.Value)
+				if byArg.Operator != "=" || err != nil {
+					info := "Syntax is BY=<seconds>;N|R[T]"
+					if err != nil {
+						info = err.Error()
+					}
+					command = InvalidCmd{Cmd: verb, Info: info}
+					err = nil
+					break
+				}
+			}
+
+			command = MailCmd{
+				From:         address,
+				EightBitMIME: eightBitMIME,
+				BinaryMIME:   binaryMIME,
+				SMTPUTF8:     smtpUTF8,
+				Size:         size,
+				Return:       ret,
+				EnvelopeId:   envelopeId,
+				RequireTLS:   requireTLS,
+				Priority:     priority,
+				DeliverBy:    deliverBy,
+			}
 		}
 
 	case "RCPT":
@@ -95,9 +223,32 @@ func (p *parser) ParseCommand(br *bufio.Reader) (command Cmd, err error) {
 			if err != nil {
 				command = InvalidCmd{Cmd: verb, Info: err.Error()}
 				err = nil
-			} else {
-				command = RcptCmd{To: address}
+				break
+			}
+
+			var notify DSNNotify
+			notifyArg, ok := args["NOTIFY"]
+			if ok {
+				notify, err = parseDSNNotify(notifyArg.Value)
+				if notifyArg.Operator != "=" || err != nil {
+					command = InvalidCmd{Cmd: verb, Info: "Syntax is NOTIFY=NEVER|SUCCESS,FAILURE,DELAY"}
+					err = nil
+					break
+				}
+			}
+
+			var originalRecipient *OriginalRecipient
+			orcptArg, ok := args["ORCPT"]
+			if ok {
+				originalRecipient, err = parseOriginalRecipient(orcptArg.Value)
+				if orcptArg.Operator != "=" || err != nil {
+					command = InvalidCmd{Cmd: verb, Info: "Syntax is ORCPT=addr-type;xtext"}
+					err = nil
+					break
+				}
 			}
+
+			command = RcptCmd{To: address, Notify: notify, OriginalRecipient: originalRecipient}
 		}
 
 	case "DATA":
@@ -108,6 +259,43 @@ func (p *parser) ParseCommand(br *bufio.Reader) (command Cmd, err error) {
 			}
 		}
 
+	case "BDAT":
+		{
+			/*
+				RFC 3030 2.
+
+				bdat-cmd   ::= "BDAT" SP chunk-size [ SP end-marker ] CR LF
+				chunk-size ::= 1*DIGIT
+				end-marker ::= "LAST"
+			*/
+			size := int64(-1)
+			last := false
+			valid := len(args) == 1 || len(args) == 2
+			for key, arg := range args {
+				if key == "LAST" && arg.Operator == "" {
+					last = true
+					continue
+				}
+				size, err = strconv.ParseInt(arg.Key, 10, 64)
+				if arg.Operator != "" || err != nil || size < 0 {
+					valid = false
+				}
+			}
+			err = nil
+
+			if !valid || size < 0 {
+				command = InvalidCmd{Cmd: verb, Info: "Syntax is BDAT <size> [LAST]"}
+				break
+			}
+
+			// The chunk is read as an exact byte count, without dot-stuffing or line length limits.
+			command = BdatCmd{
+				Size: size,
+				Last: last,
+				R:    io.LimitReader(br, size),
+			}
+		}
+
 	case "RSET":
 		{
 			command = RsetCmd{}
@@ -132,39 +320,31 @@ func (p *parser) ParseCommand(br *bufio.Reader) (command Cmd, err error) {
 		{
 			//conn.write(502, "Command not implemented")
 			/*
-					RFC 821
-					SMTP provides as additional features, commands to verify a user
-					name or expand a mailing list.  This is done with the VRFY and
-					EXPN commands
-					RFC 5321
-					As discussed in Section 3.5, individual sites may want to disable
-					either or both of VRFY or EXPN for security reasons (see below).  As
-					a corollary to the above, implementations that permit this MUST NOT
-					appear to have verified addresses that are not, in fact, verified.
-					If a site disables these commands for security reasons, the SMTP
-					server MUST return a 252 response, rather than a code that could be
-					confused with successful or unsuccessful verification.
-					Returning a 250 reply code with the address listed in the VRFY
-					command after having checked it only for syntax violates this rule.
-					Of course, an implementation that "supports" VRFY by always returning
-					550 whether or not the address is valid is equally not in
-					conformance.
-				From what I have read, 502 is better than 252...
+				RFC 821
+				SMTP provides as additional features, commands to verify a user
+				name or expand a mailing list.  This is done with the VRFY and
+				EXPN commands
+				RFC 5321
+				As discussed in Section 3.5, individual sites may want to disable
+				either or both of VRFY or EXPN for security reasons (see below).  As
+				a corollary to the above, implementations that permit this MUST NOT
+				appear to have verified addresses that are not, in fact, verified.
+				If a site disables these commands for security reasons, the SMTP
+				server MUST return a 252 response, rather than a code that could be
+				confused with successful or unsuccessful verification.
+				Returning a 250 reply code with the address listed in the VRFY
+				command after having checked it only for syntax violates this rule.
+				Of course, an implementation that "supports" VRFY by always returning
+				550 whether or not the address is valid is equally not in
+				conformance.
 			*/
-			user := ""
-			for _, arg := range args {
-				user = arg.Key
-			}
-			command = VrfyCmd{Param: user}
+			// The parameter is a user name or mailbox which can contain spaces, e.g. "VRFY Fred Smith".
+			command = VrfyCmd{Param: strings.TrimSpace(params)}
 		}
 
 	case "EXPN":
 		{
-			listName := ""
-			for _, arg := range args {
-				listName = arg.Key
-			}
-			command = ExpnCmd{ListName: listName}
+			command = ExpnCmd{ListName: strings.TrimSpace(params)}
 		}
 
 	case "NOOP":
@@ -183,24 +363,50 @@ func (p *parser) ParseCommand(br *bufio.Reader) (command Cmd, err error) {
 		}
 	case "AUTH":
 		{
-			mechanism := ""
-			initialResponse := ""
-			// TODO: make this better
-			count := 0
-			for _, arg := range args {
-				if count == 0 {
-					mechanism = arg.Key
-				}
-				if count == 1 {
-					initialResponse = arg.Key + arg.Operator + arg.Value
-				}
-				count++
+			/*
+				RFC 4954 4
 
+				AUTH mechanism [initial-response]
+			*/
+			fields := strings.Fields(params)
+			if len(fields) < 1 || len(fields) > 2 {
+				command = InvalidCmd{Cmd: verb, Info: "Syntax is AUTH mechanism [initial-response]"}
+				break
+			}
+			initialResponse := ""
+			if len(fields) == 2 {
+				initialResponse = fields[1]
 			}
 			command = AuthCmd{
-				Mechanism:       mechanism,
+				Mechanism:       strings.ToUpper(fields[0]),
 				InitialResponse: initialResponse,
-				R:               *br,
+				R:               br,
+			}
+		}
+
+	case "ETRN":
+		{
+			// ETRN takes exactly one node name (RFC 1985).
+			fields := strings.Fields(params)
+			if len(fields) != 1 || fields[0] == "@" || fields[0] == "#" {
+				command = InvalidCmd{Cmd: verb, Info: "Syntax is ETRN [@|#]node"}
+				break
+			}
+			command = EtrnCmd{Node: fields[0]}
+		}
+
+	case "XCLIENT", "XFORWARD":
+		{
+			// Postfix extensions: XCLIENT attribute=value ... and XFORWARD attribute=value ...
+			attributes, attrErr := parseAttributes(params)
+			if attrErr != nil {
+				command = InvalidCmd{Cmd: verb, Info: fmt.Sprintf("Syntax is %s attribute=value...", verb)}
+				break
+			}
+			if verb == "XCLIENT" {
+				command = XclientCmd{Attributes: attributes}
+			} else {
+				command = XforwardCmd{Attributes: attributes}
 			}
 		}
 
@@ -223,6 +429,12 @@ type Argument struct {
 
 // parseLine returns the verb of the line and a list of all comma separated arguments
 func parseLine(br *bufio.Reader) (string, map[string]Argument, error) {
+	verb, params, err := parseVerbLine(br)
+	return verb, parseArgs(params), err
+}
+
+// parseVerbLine reads a command line and returns the verb and the unparsed parameters.
+func parseVerbLine(br *bufio.Reader) (string, string, error) {
 	/*
 		RFC 5321
 		4.5.3.1.4.  Command Line
@@ -231,36 +443,57 @@ func parseLine(br *bufio.Reader) (string, map[string]Argument, error) {
 		and the <CRLF> is 512 octets.  SMTP extensions may be used to
 		increase this limit.
 	*/
+	// The AUTH extension (RFC 4954) raises the limit to 12288 octets for AUTH
+	// so that large initial responses fit on the command line.
+	// The parameters of other extensions raise the limit of MAIL and RCPT.
+	// Only the lines of those commands are read further than the normal limit.
 	buffer, err := ReadUntill('\n', MAX_CMD_LINE, br)
+	if err == ErrLtl {
+		verb, _, _ := strings.Cut(string(buffer), " ")
+		if max := maxLineLength(verb); max > len(buffer) {
+			var rest []byte
+			rest, err = ReadUntill('\n', max-len(buffer), br)
+			buffer = append(buffer, rest...)
+		}
+	}
 	if err != nil {
 		if err == ErrLtl {
 			_ = SkipTillNewline(br)
-			return string(buffer), map[string]Argument{}, err
 		}
-
-		return string(buffer), map[string]Argument{}, err
+		return string(buffer), "", err
 	}
 	line := string(buffer)
-	verb := ""
-	argMap := map[string]Argument{}
 
 	// Strip \n and \r
 	line = strings.TrimSuffix(line, "\n")
 	line = strings.TrimSuffix(line, "\r")
 
-	i := strings.Index(line, " ")
-	if i == -1 {
-		verb = strings.ToUpper(line)
-		return verb, map[string]Argument{}, nil
+	verb, params, _ := strings.Cut(line, " ")
+	return strings.ToUpper(verb), params, nil
+}
+
+// maxLineLength returns the maximum length of the command line of the verb.
+func maxLineLength(verb string) int {
+	switch strings.ToUpper(verb) {
+	case "AUTH":
+		return MAX_AUTH_LINE
+	case "MAIL":
+		return MAX_MAIL_LINE
+	case "RCPT":
+		return MAX_RCPT_LINE
+	default:
+		return MAX_CMD_LINE
 	}
+}
 
-	verb = strings.ToUpper(line[:i])
-	line = line[i+1:]
+// parseArgs splits the parameters of a command line in a map of arguments.
+func parseArgs(params string) map[string]Argument {
+	argMap := map[string]Argument{}
 
-	tmpArgs := strings.Split(line, " ")
+	tmpArgs := strings.Split(params, " ")
 	for _, arg := range tmpArgs {
 		argument := Argument{}
-		i = strings.IndexAny(arg, ":=")
+		i := strings.IndexAny(arg, ":=")
 		if i == -1 {
 			argument.Key = strings.TrimSpace(arg)
 		} else {
@@ -278,7 +511,27 @@ func parseLine(br *bufio.Reader) (string, map[string]Argument, error) {
 		argMap[strings.ToUpper(argument.Key)] = argument
 	}
 
-	return verb, argMap, nil
+	return argMap
+}
+
+// parseAttributes parses a list of xtext encoded attribute=value pairs of XCLIENT and XFORWARD.
+func parseAttributes(params string) (map[string]string, error) {
+	attributes := map[string]string{}
+	for _, field := range strings.Fields(params) {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid attribute: %q", field)
+		}
+		decoded, err := DecodeXtext(value)
+		if err != nil {
+			return nil, err
+		}
+		attributes[strings.ToUpper(name)] = decoded
+	}
+	if len(attributes) == 0 {
+		return nil, errors.New("no attributes given")
+	}
+	return attributes, nil
 }
 
 func parseFROM(from string) (*MailAddress, error) {
@@ -331,14 +584,20 @@ func ParseAuthPlainInitialRespone(initialResponse string) (authorizationIdentity
 		err = fmt.Errorf("couldn't decode base64 %v", err)
 		return
 	}
-	initialResponseByteSplit := bytes.Split(initialResponseByte, []byte("\x00"))
-	if len(initialResponseByteSplit) != 3 {
+	return ParseAuthPlainResponse(initialResponseByte)
+}
+
+// ParseAuthPlainResponse parses the decoded response of an Auth PLAIN request.
+// See ParseAuthPlainInitialRespone.
+func ParseAuthPlainResponse(response []byte) (authorizationIdentity string, authenticationIdenity string, password string, err error) {
+	responseSplit := bytes.Split(response, []byte("\x00"))
+	if len(responseSplit) != 3 {
 		err = fmt.Errorf("couldn't parse initial response: expected exactly 3 arguments")
 		return
 	}
 
-	authorizationIdentity = string(initialResponseByteSplit[0])
-	authenticationIdenity = string(initialResponseByteSplit[1])
-	password = string(initialResponseByteSplit[2])
+	authorizationIdentity = string(responseSplit[0])
+	authenticationIdenity = string(responseSplit[1])
+	password = string(responseSplit[2])
 	return
 }
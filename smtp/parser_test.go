@@ -3,8 +3,10 @@ package smtp
 import (
 	"bufio"
 	_ "fmt"
+	"io"
 	"strings"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -18,23 +20,36 @@ func TestParser(t *testing.T) {
 		commands += "helo relay.example.org\r\n"
 		commands += "helO relay.example.org\r\n"
 		commands += "EHLO other.example.org\r\n"
+		commands += "LHLO lmtp.example.org\r\n"
 		commands += "MAIL FROM:<bob@example.org>\r\n"
 		commands += "MAIL FROM:<BOB@example.org>\r\n"
 		commands += "mail FROM:<bob@example.org>\r\n"
 		commands += "MAIL FROM:<bob@example.org> body=8BITMIME\r\n"
 		commands += "MAIL FROM:<bob@example.org> BODY=8bitmime\r\n"
 		commands += "MAIL FROM:<bob@example.org> BODY=7bit\r\n"
+		commands += "MAIL FROM:<bob@example.org> SIZE=1000\r\n"
+		commands += "MAIL FROM:<bob@example.org> BODY=8BITMIME SIZE=0\r\n"
+		commands += "MAIL FROM:<bob@example.org> BODY=BINARYMIME\r\n"
+		commands += "MAIL FROM:<δοκιμή@παράδειγμα.δοκιμή> SMTPUTF8\r\n"
+		commands += "MAIL FROM:<bob@example.org> RET=hdrs ENVID=QQ314159+2B1\r\n"
+		commands += "MAIL FROM:<bob@example.org> REQUIRETLS\r\n"
+		commands += "MAIL FROM:<bob@example.org> MT-PRIORITY=-3 BY=120;rT\r\n"
 		commands += "RCPT TO:<alice@example.com>\r\n"
 		commands += "RCPT TO:<theboss@example.com>\r\n"
 		commands += "RCPT to:<theboss@example.com>\r\n"
 		commands += "rcpt to:<Theboss@example.com>\r\n"
+		commands += "RCPT TO:<alice@example.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;alice+2Bold@example.com\r\n"
 		commands += "SEND\r\n"
 		commands += "SOML\r\n"
 		commands += "SAML\r\n"
 		commands += "RSET\r\n"
 		commands += "VRFY jones\r\n"
+		commands += "VRFY Fred Smith\r\n"
 		commands += "EXPN staff\r\n"
 		commands += "NOOP\r\n"
+		commands += "ETRN @example.org\r\n"
+		commands += "XCLIENT NAME=spike.porcupine.org ADDR=168.100.189.2 login=wietse+2Bx\r\n"
+		commands += "XFORWARD NAME=[UNAVAILABLE] ADDR=IPV6:2001:db8::1\r\n"
 		commands += "QUIT\r\n"
 		// commands += "AUTH PLAIN\r\n"
 		// commands += "AUTH PLAIN dGVzdAB0ZXN0ADEyMzQ=\r\n"
@@ -49,23 +64,44 @@ func TestParser(t *testing.T) {
 			HeloCmd{Domain: "relay.example.org"},
 			HeloCmd{Domain: "relay.example.org"},
 			EhloCmd{Domain: "other.example.org"},
+			LhloCmd{Domain: "lmtp.example.org"},
 			MailCmd{From: &MailAddress{Address: "bob@example.org"}},
 			MailCmd{From: &MailAddress{Address: "BOB@example.org"}},
 			MailCmd{From: &MailAddress{Address: "bob@example.org"}},
 			MailCmd{From: &MailAddress{Address: "bob@example.org"}, EightBitMIME: true},
 			MailCmd{From: &MailAddress{Address: "bob@example.org"}, EightBitMIME: true},
 			MailCmd{From: &MailAddress{Address: "bob@example.org"}},
+			MailCmd{From: &MailAddress{Address: "bob@example.org"}, Size: 1000},
+			MailCmd{From: &MailAddress{Address: "bob@example.org"}, EightBitMIME: true},
+			MailCmd{From: &MailAddress{Address: "bob@example.org"}, BinaryMIME: true},
+			MailCmd{From: &MailAddress{Address: "δοκιμή@παράδειγμα.δοκιμή"}, SMTPUTF8: true},
+			MailCmd{From: &MailAddress{Address: "bob@example.org"}, Return: DSNReturnHeaders, EnvelopeId: "QQ314159+1"},
+			MailCmd{From: &MailAddress{Address: "bob@example.org"}, RequireTLS: true},
+			MailCmd{
+				From:      &MailAddress{Address: "bob@example.org"},
+				Priority:  -3,
+				DeliverBy: &DeliverBy{Time: 120 * time.Second, Mode: DeliverByReturn, Trace: true},
+			},
 			RcptCmd{To: &MailAddress{Address: "alice@example.com"}},
 			RcptCmd{To: &MailAddress{Address: "theboss@example.com"}},
 			RcptCmd{To: &MailAddress{Address: "theboss@example.com"}},
 			RcptCmd{To: &MailAddress{Address: "Theboss@example.com"}},
+			RcptCmd{
+				To:                &MailAddress{Address: "alice@example.com"},
+				Notify:            DSNNotifySuccess | DSNNotifyFailure,
+				OriginalRecipient: &OriginalRecipient{AddressType: "rfc822", Address: "alice+old@example.com"},
+			},
 			SendCmd{},
 			SomlCmd{},
 			SamlCmd{},
 			RsetCmd{},
 			VrfyCmd{Param: "jones"},
+			VrfyCmd{Param: "Fred Smith"},
 			ExpnCmd{ListName: "staff"},
 			NoopCmd{},
+			EtrnCmd{Node: "@example.org"},
+			XclientCmd{Attributes: map[string]string{"NAME": "spike.porcupine.org", "ADDR": "168.100.189.2", "LOGIN": "wietse+x"}},
+			XforwardCmd{Attributes: map[string]string{"NAME": "[UNAVAILABLE]", "ADDR": "IPV6:2001:db8::1"}},
 			QuitCmd{},
 			// AuthCmd{Mechanism: "PLAIN"},
 			// AuthCmd{Mechanism: "PLAIN", InitialResponse: "dGVzdAB0ZXN0ADEyMzQ="},
@@ -79,6 +115,34 @@ func TestParser(t *testing.T) {
 
 	})
 
+	Convey("Testing parser line length of DSN parameters", t, func() {
+		// DSN (RFC 3461 4.) raises the maximum line length of RCPT by 500 octets.
+		longAddress := strings.Repeat("a", 470) + "@example.com"
+		commands := ""
+		commands += "RCPT TO:<b@b.c> NOTIFY=FAILURE ORCPT=rfc822;" + longAddress + "\r\n"
+		commands += "RCPT TO:<b@b.c> NOTIFY=FAILURE ORCPT=rfc822;" + strings.Repeat("a", 1000) + "\r\n"
+		commands += "NOOP " + strings.Repeat("x", 600) + "\r\n"
+		commands += "QUIT\r\n"
+
+		br := bufio.NewReader(strings.NewReader(commands))
+		p := parser{}
+
+		command, err := p.ParseCommand(br)
+		So(err, ShouldEqual, nil)
+		So(command.(RcptCmd).OriginalRecipient.Address, ShouldEqual, longAddress)
+
+		_, err = p.ParseCommand(br)
+		So(err, ShouldEqual, ErrLtl)
+
+		_, err = p.ParseCommand(br)
+		So(err, ShouldEqual, ErrLtl)
+
+		// The rest of the long lines was skipped.
+		command, err = p.ParseCommand(br)
+		So(err, ShouldEqual, nil)
+		So(command, ShouldHaveSameTypeAs, QuitCmd{})
+	})
+
 	Convey("Testing parser DATA cmd", t, func() {
 		commands := ""
 		commands += "DATA\r\n"
@@ -97,6 +161,90 @@ func TestParser(t *testing.T) {
 
 	})
 
+	Convey("Testing parser BDAT cmd", t, func() {
+		commands := ""
+		commands += "BDAT 9\r\n"
+		commands += "QUIT\r\n.\r\n"
+		commands += "BDAT 6 last\r\n"
+		commands += "\x00\x01\r\n\r\n"
+		commands += "BDAT 0 LAST\r\n"
+		commands += "quit\r\n"
+
+		br := bufio.NewReader(strings.NewReader(commands))
+		p := parser{}
+
+		command, err := p.ParseCommand(br)
+		So(err, ShouldEqual, nil)
+		So(command, ShouldHaveSameTypeAs, BdatCmd{})
+		So(command.(BdatCmd).Size, ShouldEqual, 9)
+		So(command.(BdatCmd).Last, ShouldBeFalse)
+		chunk, err := io.ReadAll(command.(BdatCmd).R)
+		So(err, ShouldEqual, nil)
+		So(string(chunk), ShouldEqual, "QUIT\r\n.\r\n")
+
+		command, err = p.ParseCommand(br)
+		So(err, ShouldEqual, nil)
+		So(command.(BdatCmd).Size, ShouldEqual, 6)
+		So(command.(BdatCmd).Last, ShouldBeTrue)
+		chunk, err = io.ReadAll(command.(BdatCmd).R)
+		So(err, ShouldEqual, nil)
+		So(string(chunk), ShouldEqual, "\x00\x01\r\n\r\n")
+
+		command, err = p.ParseCommand(br)
+		So(err, ShouldEqual, nil)
+		So(command.(BdatCmd).Size, ShouldEqual, 0)
+		So(command.(BdatCmd).Last, ShouldBeTrue)
+		chunk, err = io.ReadAll(command.(BdatCmd).R)
+		So(err, ShouldEqual, nil)
+		So(chunk, ShouldBeEmpty)
+
+		command, err = p.ParseCommand(br)
+		So(err, ShouldEqual, nil)
+		So(command, ShouldHaveSameTypeAs, QuitCmd{})
+	})
+
+	Convey("Testing parser AUTH cmd", t, func() {
+		longResponse := strings.Repeat("A", 1000)
+		commands := ""
+		commands += "AUTH plain\r\n"
+		commands += "AUTH PLAIN dGVzdAB0ZXN0ADEyMzQ=\r\n"
+		commands += "AUTH EXTERNAL =\r\n"
+		commands += "AUTH X-LONG " + longResponse + "\r\n"
+		commands += "NOOP " + longResponse + "\r\n"
+		commands += "AUTH\r\n"
+
+		br := bufio.NewReader(strings.NewReader(commands))
+		p := parser{}
+
+		command, err := p.ParseCommand(br)
+		So(err, ShouldEqual, nil)
+		So(command.(AuthCmd).Mechanism, ShouldEqual, "PLAIN")
+		So(command.(AuthCmd).InitialResponse, ShouldEqual, "")
+		So(command.(AuthCmd).R, ShouldEqual, br)
+
+		command, err = p.ParseCommand(br)
+		So(err, ShouldEqual, nil)
+		So(command.(AuthCmd).Mechanism, ShouldEqual, "PLAIN")
+		So(command.(AuthCmd).InitialResponse, ShouldEqual, "dGVzdAB0ZXN0ADEyMzQ=")
+
+		command, err = p.ParseCommand(br)
+		So(err, ShouldEqual, nil)
+		So(command.(AuthCmd).Mechanism, ShouldEqual, "EXTERNAL")
+		So(command.(AuthCmd).InitialResponse, ShouldEqual, "=")
+
+		// AUTH command lines may be longer than other command lines (RFC 4954)
+		command, err = p.ParseCommand(br)
+		So(err, ShouldEqual, nil)
+		So(command.(AuthCmd).InitialResponse, ShouldEqual, longResponse)
+
+		_, err = p.ParseCommand(br)
+		So(err, ShouldEqual, ErrLtl)
+
+		command, err = p.ParseCommand(br)
+		So(err, ShouldEqual, nil)
+		So(command, ShouldHaveSameTypeAs, InvalidCmd{})
+	})
+
 	Convey("Testing parser with invalid commands", t, func() {
 
 		commands := ""
@@ -115,6 +263,26 @@ func TestParser(t *testing.T) {
 		commands += "MAIL FROA:valid@mail.be\r\n"
 		commands += "MAIL To some@invalid\r\n"
 		commands += "MAIL FROM:some@valid.be BODY:8bitmime\r\n"
+		commands += "MAIL FROM:some@valid.be SIZE=big\r\n"
+		commands += "MAIL FROM:some@valid.be SIZE=-10\r\n"
+		commands += "MAIL FROM:some@valid.be SMTPUTF8=yes\r\n"
+		commands += "MAIL FROM:some@valid.be RET=ALL\r\n"
+		commands += "MAIL FROM:some@valid.be ENVID=a=b\r\n"
+		commands += "MAIL FROM:some@valid.be REQUIRETLS=yes\r\n"
+		commands += "XCLIENT\r\n"
+		commands += "ETRN\r\n"
+		commands += "MAIL FROM:some@valid.be MT-PRIORITY=10\r\n"
+		commands += "MAIL FROM:some@valid.be BY=0;R\r\n"
+		commands += "ETRN #\r\n"
+		commands += "XCLIENT NAME\r\n"
+		commands += "XFORWARD ADDR=a+zz\r\n"
+		commands += "RCPT TO:some@valid.be NOTIFY=NEVER,DELAY\r\n"
+		commands += "RCPT TO:some@valid.be ORCPT=some@valid.be\r\n"
+		commands += "BDAT\r\n"
+		commands += "BDAT LAST\r\n"
+		commands += "BDAT -1\r\n"
+		commands += "BDAT 10 FIRST\r\n"
+		commands += "BDAT 10 LAST SOMETHING\r\n"
 		commands += "UNKN some unknown command\r\n"
 
 		br := bufio.NewReader(strings.NewReader(commands))
@@ -137,6 +305,26 @@ func TestParser(t *testing.T) {
 			InvalidCmd{},
 			InvalidCmd{},
 			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
 			UnknownCmd{},
 		}
 
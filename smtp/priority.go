@@ -0,0 +1,32 @@
+package smtp
+
+import (
+	"errors"
+	"strings"
+)
+
+// Priority is the MT-PRIORITY parameter of the MAIL command (RFC 6710).
+// It ranges from MinPriority to MaxPriority, the zero value is the normal priority.
+type Priority int
+
+const (
+	MinPriority Priority = -9
+	MaxPriority Priority = 9
+)
+
+// parsePriority parses the value of a MT-PRIORITY parameter.
+func parsePriority(value string) (Priority, error) {
+	// The value is a single digit with an optional "-" or "+" sign.
+	sign := 1
+	if strings.HasPrefix(value, "-") {
+		sign = -1
+		value = value[1:]
+	} else if strings.HasPrefix(value, "+") {
+		value = value[1:]
+	}
+
+	if len(value) != 1 || value[0] < '0' || value[0] > '9' {
+		return 0, errors.New("Syntax is MT-PRIORITY=[-|+]0-9")
+	}
+	return Priority(sign * int(value[0]-'0')), nil
+}
@@ -0,0 +1,24 @@
+package smtp
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPriority(t *testing.T) {
+
+	Convey("Testing parsePriority()", t, func() {
+		valid := map[string]Priority{"0": 0, "9": MaxPriority, "-9": MinPriority, "+4": 4, "-0": 0}
+		for value, expected := range valid {
+			priority, err := parsePriority(value)
+			So(err, ShouldBeNil)
+			So(priority, ShouldEqual, expected)
+		}
+
+		for _, value := range []string{"", "10", "-10", "+", "a", "--1", "1.5"} {
+			_, err := parsePriority(value)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
@@ -2,12 +2,17 @@ package smtp
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -16,17 +21,21 @@ type StatusCode uint32
 
 // SMTP status codes
 const (
-	Ready             StatusCode = 220
-	Closing           StatusCode = 221
-	Ok                StatusCode = 250
-	StartData         StatusCode = 354
-	ShuttingDown      StatusCode = 421
-	SyntaxError       StatusCode = 500
-	SyntaxErrorParam  StatusCode = 501
-	NotImplemented    StatusCode = 502
-	BadSequence       StatusCode = 503
-	AbortMail         StatusCode = 552
-	NoValidRecipients StatusCode = 554
+	Ready              StatusCode = 220
+	Closing            StatusCode = 221
+	Ok                 StatusCode = 250
+	UserNotLocal       StatusCode = 251
+	CannotVerify       StatusCode = 252
+	StartData          StatusCode = 354
+	ShuttingDown       StatusCode = 421
+	SyntaxError        StatusCode = 500
+	SyntaxErrorParam   StatusCode = 501
+	NotImplemented     StatusCode = 502
+	BadSequence        StatusCode = 503
+	EncryptionNeeded   StatusCode = 530
+	MailboxUnavailable StatusCode = 550
+	AbortMail          StatusCode = 552
+	NoValidRecipients  StatusCode = 554
 )
 
 // SMTP status codes for AUTH extension (RFC 4954)
@@ -45,15 +54,36 @@ const (
 	EncryptionRequiredForRequestedAuthenticationMechanism StatusCode = 538
 )
 
+// SMTP status codes for ETRN extension (RFC 1985)
+const (
+	QueuingStarted         StatusCode = 250
+	NoMessagesWaiting      StatusCode = 251
+	PendingMessagesStarted StatusCode = 252
+	MessagesStarted        StatusCode = 253
+	UnableToQueueMessages  StatusCode = 458
+	NodeNotAllowed         StatusCode = 459
+)
+
 // ErrLtl Line too long error
 var ErrLtl = errors.New("line too long")
 
 // ErrIncomplete Incomplete data error
 var ErrIncomplete = errors.New("incomplete data")
 
+// ErrTooLarge Message exceeds the maximum message size error
+var ErrTooLarge = errors.New("message too large")
+
+// ErrTimeout The client didn't send anything before the timeout error
+var ErrTimeout = errors.New("timeout")
+
 const (
 	MAX_DATA_LINE = 1000
 	MAX_CMD_LINE  = 512
+	MAX_AUTH_LINE = 12288
+	// SIZE (RFC 1870 8.) adds 26 octets and DSN (RFC 3461 4.) 100 octets for RET and ENVID to MAIL.
+	MAX_MAIL_LINE = MAX_CMD_LINE + 26 + 100
+	// DSN (RFC 3461 4.) adds 500 octets for NOTIFY and ORCPT to RCPT.
+	MAX_RCPT_LINE = MAX_CMD_LINE + 500
 )
 
 // ReadUntill reads untill delim is found or max bytes are read.
@@ -108,6 +138,8 @@ type DataReader struct {
 	br          *bufio.Reader
 	state       int
 	bytesInLine int
+	size        int64
+	maxSize     int64
 }
 
 func NewDataReader(br *bufio.Reader) *DataReader {
@@ -118,6 +150,25 @@ func NewDataReader(br *bufio.Reader) *DataReader {
 	return dr
 }
 
+// SetMaxSize sets the maximum size of the message in octets as it was sent, with CRLF line endings.
+// When the message grows past max octets, the rest of the message is discarded
+// and ErrTooLarge is returned. A max of 0 means no limit.
+func (r *DataReader) SetMaxSize(max int64) {
+	r.maxSize = max
+}
+
+// discard reads and drops the remaining data untill the end marker is found.
+func (r *DataReader) discard() error {
+	r.maxSize = 0
+	for {
+		_, err := io.Copy(io.Discard, r)
+		if err == ErrLtl {
+			continue
+		}
+		return err
+	}
+}
+
 // Implementation from textproto.DotReader.Read
 func (r *DataReader) Read(b []byte) (n int, err error) {
 	// Run data through a simple state machine to
@@ -135,9 +186,14 @@ func (r *DataReader) Read(b []byte) (n int, err error) {
 	br := r.br
 	for n < len(b) && r.state != stateEOF {
 		var c byte
+		// The number of octets of the message as it was sent (RFC 1870), a CRLF is rewritten to \n
+		// but counts as 2. Dots added for transparency and the end marker don't count.
+		octets := int64(1)
 		c, err = br.ReadByte()
 		if err != nil {
-			err = ErrIncomplete
+			if err != ErrTimeout {
+				err = ErrIncomplete
+			}
 			break
 		}
 		r.bytesInLine++
@@ -189,6 +245,7 @@ func (r *DataReader) Read(b []byte) (n int, err error) {
 			if c == '\n' {
 				r.state = stateBeginLine
 				r.bytesInLine = 0
+				octets = 2
 				break
 			}
 			// Not part of \r\n.  Emit saved \r
@@ -209,8 +266,16 @@ func (r *DataReader) Read(b []byte) (n int, err error) {
 				r.bytesInLine = 0
 			}
 		}
+		if r.maxSize > 0 && r.size+octets > r.maxSize {
+			err = ErrTooLarge
+			if discardErr := r.discard(); discardErr != nil {
+				err = discardErr
+			}
+			return
+		}
 		b[n] = c
 		n++
+		r.size += octets
 	}
 
 	if err == nil && r.state == stateEOF {
@@ -225,20 +290,72 @@ type Cmd interface {
 	fmt.Stringer
 }
 
+// EnhancedCode An enhanced mail system status code (RFC 3463) in the form
+// class.subject.detail, e.g. 5.7.8. The zero value means no enhanced code.
+type EnhancedCode [3]int
+
+func (c EnhancedCode) String() string {
+	return fmt.Sprintf("%d.%d.%d", c[0], c[1], c[2])
+}
+
+// IsZero returns whether no enhanced code is set.
+func (c EnhancedCode) IsZero() bool {
+	return c == EnhancedCode{}
+}
+
+// ParseEnhancedCode parses an enhanced status code like "5.7.8".
+func ParseEnhancedCode(s string) (EnhancedCode, error) {
+	/*
+		RFC 3463 2.
+
+		status-code = class "." subject "." detail
+		class = "2"/"4"/"5"
+		subject = 1*3digit
+		detail = 1*3digit
+	*/
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return EnhancedCode{}, fmt.Errorf("invalid enhanced status code: %q", s)
+	}
+
+	code := EnhancedCode{}
+	for i, part := range parts {
+		if len(part) == 0 || len(part) > 3 {
+			return EnhancedCode{}, fmt.Errorf("invalid enhanced status code: %q", s)
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return EnhancedCode{}, fmt.Errorf("invalid enhanced status code: %q", s)
+		}
+		code[i] = n
+	}
+
+	if code[0] != 2 && code[0] != 4 && code[0] != 5 {
+		return EnhancedCode{}, fmt.Errorf("invalid enhanced status code class: %q", s)
+	}
+
+	return code, nil
+}
+
 // Answer A raw SMTP answer. Used to send a status code + message.
 type Answer struct {
-	Status  StatusCode
-	Message string
+	Status       StatusCode
+	EnhancedCode EnhancedCode
+	Message      string
 }
 
 func (c Answer) String() string {
-	return fmt.Sprintf("%d %s", c.Status, c.Message)
+	if c.EnhancedCode.IsZero() {
+		return fmt.Sprintf("%d %s", c.Status, c.Message)
+	}
+	return fmt.Sprintf("%d %s %s", c.Status, c.EnhancedCode, c.Message)
 }
 
 // MultiAnswer A multiline answer.
 type MultiAnswer struct {
-	Status   StatusCode
-	Messages []string
+	Status       StatusCode
+	EnhancedCode EnhancedCode
+	Messages     []string
 }
 
 func (c MultiAnswer) String() string {
@@ -246,13 +363,19 @@ func (c MultiAnswer) String() string {
 		return fmt.Sprintf("%d", c.Status)
 	}
 
+	// RFC 2034 3: every line of a multiline reply carries the enhanced code
+	prefix := ""
+	if !c.EnhancedCode.IsZero() {
+		prefix = c.EnhancedCode.String() + " "
+	}
+
 	result := ""
 	for i := 0; i < len(c.Messages)-1; i++ {
-		result += fmt.Sprintf("%d-%s", c.Status, c.Messages[i])
+		result += fmt.Sprintf("%d-%s%s", c.Status, prefix, c.Messages[i])
 		result += "\r\n"
 	}
 
-	result += fmt.Sprintf("%d %s", c.Status, c.Messages[len(c.Messages)-1])
+	result += fmt.Sprintf("%d %s%s", c.Status, prefix, c.Messages[len(c.Messages)-1])
 
 	return result
 }
@@ -295,6 +418,15 @@ func (c EhloCmd) String() string {
 	return ""
 }
 
+// LhloCmd is the LMTP replacement of EHLO (RFC 2033 4.1).
+type LhloCmd struct {
+	Domain string
+}
+
+func (c LhloCmd) String() string {
+	return ""
+}
+
 type QuitCmd struct {
 }
 
@@ -305,6 +437,20 @@ func (c QuitCmd) String() string {
 type MailCmd struct {
 	From         *MailAddress
 	EightBitMIME bool
+	BinaryMIME   bool
+	// SMTPUTF8 is set when the client requested an internationalized transaction (RFC 6531).
+	SMTPUTF8 bool
+	// Size is the message size declared by the client (RFC 1870), 0 if not given.
+	Size int64
+	// Return and EnvelopeId are the DSN parameters (RFC 3461).
+	Return     DSNReturn
+	EnvelopeId string
+	// RequireTLS is set when the message must only be relayed over TLS (RFC 8689).
+	RequireTLS bool
+	// Priority is the MT-PRIORITY parameter (RFC 6710).
+	Priority Priority
+	// DeliverBy is the BY parameter (RFC 2852), nil if not given.
+	DeliverBy *DeliverBy
 }
 
 func (c MailCmd) String() string {
@@ -313,6 +459,9 @@ func (c MailCmd) String() string {
 
 type RcptCmd struct {
 	To *MailAddress
+	// Notify and OriginalRecipient are the DSN parameters (RFC 3461).
+	Notify            DSNNotify
+	OriginalRecipient *OriginalRecipient
 }
 
 func (c RcptCmd) String() string {
@@ -328,6 +477,18 @@ func (c DataCmd) String() string {
 	return ""
 }
 
+// BdatCmd is a BDAT command (RFC 3030) which is followed by a chunk of exactly Size bytes.
+type BdatCmd struct {
+	Size int64
+	Last bool
+	// R reads the chunk, it must be read completely before reading the next command.
+	R io.Reader
+}
+
+func (c BdatCmd) String() string {
+	return ""
+}
+
 type RsetCmd struct {
 }
 
@@ -386,13 +547,44 @@ func (c SamlCmd) String() string {
 type AuthCmd struct {
 	Mechanism       string
 	InitialResponse string
-	R               bufio.Reader
+	R               *bufio.Reader
 }
 
 func (c AuthCmd) String() string {
 	return fmt.Sprintf("AUTH %s", c.Mechanism)
 }
 
+// EtrnCmd requests to start the delivery of the mail queued for a node (RFC 1985).
+type EtrnCmd struct {
+	// Node is a domain name, "@" followed by a domain name for the domain and its subdomains
+	// or "#" followed by the name of a queue.
+	Node string
+}
+
+func (c EtrnCmd) String() string {
+	return ""
+}
+
+// XclientCmd overrides the client attributes of the session, sent by a trusted proxy.
+// The attribute names are upper case and the values are xtext decoded.
+type XclientCmd struct {
+	Attributes map[string]string
+}
+
+func (c XclientCmd) String() string {
+	return ""
+}
+
+// XforwardCmd forwards the client attributes of the original session, sent by a trusted proxy.
+// The attribute names are upper case and the values are xtext decoded.
+type XforwardCmd struct {
+	Attributes map[string]string
+}
+
+func (c XforwardCmd) String() string {
+	return ""
+}
+
 type Id struct {
 	Timestamp int64
 	Counter   uint32
@@ -420,33 +612,151 @@ type Protocol interface {
 	GetState() *State
 }
 
+// DisconnectWatcher is implemented by a Protocol which can detect that the client
+// closed the connection while the server isn't reading commands.
+type DisconnectWatcher interface {
+	// WatchDisconnect returns a context which is cancelled when the client closes the connection.
+	// The stop function must be called before the next command is read.
+	WatchDisconnect(parent context.Context) (ctx context.Context, stop func())
+}
+
+// Timeouter is implemented by a Protocol which can stop waiting for the client.
+// Reads which time out return ErrTimeout.
+type Timeouter interface {
+	// SetTimeout sets the maximum time of every read from and write to the client.
+	// 0 means no timeout.
+	SetTimeout(timeout time.Duration)
+	// SetDeadline sets the time after which all reads fail, e.g. the end of the maximum session duration.
+	// The zero time means no deadline.
+	SetDeadline(deadline time.Time)
+}
+
 type MtaProtocol struct {
-	c      net.Conn
-	br     *bufio.Reader
-	parser parser
-	state  *State
+	c  net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+	// Guards bw, the server can send a reply while a command is being read, e.g. when shutting down.
+	wmu      sync.Mutex
+	parser   parser
+	state    *State
+	timeout  time.Duration
+	deadline time.Time
 }
 
 // NewMtaProtocol Creates a protocol that works over a socket.
 // the net.Conn parameter will be closed when done.
+// If it is a *tls.Conn (implicit TLS) the handshake must be completed,
+// the state is then secure from the start.
+// If it is a *ProxyConn, GetIP returns the ip of the original client.
 func NewMtaProtocol(c net.Conn) *MtaProtocol {
 	proto := &MtaProtocol{
 		c:      c,
-		br:     bufio.NewReader(c),
+		bw:     bufio.NewWriter(c),
 		parser: parser{},
 		state:  &State{},
 	}
+	proto.br = bufio.NewReader(connReader{p: proto})
+
+	if tlsCon, ok := c.(*tls.Conn); ok {
+		proto.setTLSState(tlsCon)
+	}
+	proto.state.Proxy = proxyHeaderOf(c)
 
 	return proto
 }
 
+// setTLSState sets the TLS connection state of a completed handshake.
+func (p *MtaProtocol) setTLSState(tlsCon *tls.Conn) {
+	cs := tlsCon.ConnectionState()
+	p.state.Secure = true
+	p.state.TLSState = &cs
+	// Only set if the tls.Config requested and verified a client certificate.
+	p.state.VerifiedChains = cs.VerifiedChains
+}
+
+// connReader reads from the connection of a MtaProtocol.
+//
+// The server may send the replies to a group of pipelined commands in one
+// batch, but it must send them before it blocks waiting for more input (RFC 2920).
+// So all buffered replies are flushed before we read from the socket, which
+// only happens when the bufio.Reader has no more pipelined input buffered.
+type connReader struct {
+	p *MtaProtocol
+}
+
+func (r connReader) Read(b []byte) (int, error) {
+	err := r.p.flush()
+	if err != nil {
+		return 0, err
+	}
+
+	if deadline := r.p.readDeadline(); !deadline.IsZero() {
+		err = r.p.c.SetReadDeadline(deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.p.c.Read(b)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, ErrTimeout
+	}
+	return n, err
+}
+
+// SetTimeout sets the maximum time of every read and write.
+func (p *MtaProtocol) SetTimeout(timeout time.Duration) {
+	p.timeout = timeout
+	p.clearDeadlines()
+}
+
+// SetDeadline sets the time after which all reads fail.
+func (p *MtaProtocol) SetDeadline(deadline time.Time) {
+	p.deadline = deadline
+	p.clearDeadlines()
+}
+
+// clearDeadlines removes the deadlines of the connection when there are no timeouts anymore,
+// otherwise they are set before every read and write.
+func (p *MtaProtocol) clearDeadlines() {
+	if p.timeout == 0 && p.deadline.IsZero() {
+		_ = p.c.SetDeadline(time.Time{})
+	}
+}
+
+// readDeadline returns the deadline of the next read, the zero time if there is none.
+func (p *MtaProtocol) readDeadline() time.Time {
+	deadline := p.deadline
+	if p.timeout > 0 {
+		timeout := time.Now().Add(p.timeout)
+		if deadline.IsZero() || timeout.Before(deadline) {
+			deadline = timeout
+		}
+	}
+	return deadline
+}
+
 func (p *MtaProtocol) Send(c Cmd) {
 	log.WithFields(log.Fields{
 		"Cmd":       fmt.Sprintf("%#v", c),
 		"SessionId": p.state.SessionId.String(),
 		"Ip":        p.state.Ip.String(),
 	}).Debug("Sending cmd")
-	fmt.Fprintf(p.c, "%s\r\n", c)
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	fmt.Fprintf(p.bw, "%s\r\n", c)
+}
+
+func (p *MtaProtocol) flush() error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	if p.timeout > 0 && p.bw.Buffered() > 0 {
+		err := p.c.SetWriteDeadline(time.Now().Add(p.timeout))
+		if err != nil {
+			return err
+		}
+	}
+	return p.bw.Flush()
 }
 
 func (p *MtaProtocol) GetCmd() (*Cmd, error) {
@@ -467,25 +777,87 @@ func (p *MtaProtocol) GetCmd() (*Cmd, error) {
 }
 
 func (p *MtaProtocol) Close() {
-	err := p.c.Close()
+	err := p.flush()
+	if err != nil {
+		log.Printf("Error while flushing protocol: %v", err)
+	}
+
+	err = p.c.Close()
 	if err != nil {
 		log.Printf("Error while closing protocol: %v", err)
 	}
 }
 
 func (p *MtaProtocol) StartTls(c *tls.Config) error {
+	// Make sure the client received our answer before starting the handshake.
+	err := p.flush()
+	if err != nil {
+		return err
+	}
+
 	tlsCon := tls.Server(p.c, c)
-	err := tlsCon.Handshake()
+	if deadline := p.readDeadline(); !deadline.IsZero() {
+		err = p.c.SetDeadline(deadline)
+		if err != nil {
+			return err
+		}
+	}
+	err = tlsCon.Handshake()
 	if err != nil {
 		return err
 	}
 
 	p.c = tlsCon
-	p.br.Reset(p.c)
+	p.setTLSState(tlsCon)
+	// Discard any plaintext commands pipelined after STARTTLS.
+	p.br.Reset(connReader{p: p})
+	p.bw.Reset(p.c)
 	return nil
 }
 
+// WatchDisconnect waits in the background for the connection to be closed by the client.
+// Pipelined input is left in the buffer for the next command.
+func (p *MtaProtocol) WatchDisconnect(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	// Waiting for the client to disconnect must not time out.
+	timeout, deadline := p.timeout, p.deadline
+	p.timeout, p.deadline = 0, time.Time{}
+	_ = p.c.SetReadDeadline(time.Time{})
+
+	go func() {
+		defer close(stopped)
+		_, err := p.br.Peek(1)
+		select {
+		case <-done:
+			// Stopped by the server, the error is the read deadline.
+		default:
+			if err != nil {
+				cancel()
+			}
+		}
+	}()
+
+	stop := func() {
+		close(done)
+		// Unblock the Peek and wait for it before the next command is read.
+		_ = p.c.SetReadDeadline(time.Now())
+		<-stopped
+		_ = p.c.SetReadDeadline(time.Time{})
+		p.timeout, p.deadline = timeout, deadline
+		cancel()
+	}
+	return ctx, stop
+}
+
 func (p *MtaProtocol) GetIP() net.IP {
+	// Unix socket connections don't have an ip.
+	if _, ok := p.c.RemoteAddr().(*net.UnixAddr); ok {
+		return nil
+	}
+
 	ip, _, err := net.SplitHostPort(p.c.RemoteAddr().String())
 	if err != nil {
 		log.Printf("Could not get ip: %v", p.c.RemoteAddr().String())
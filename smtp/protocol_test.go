@@ -0,0 +1,302 @@
+package smtp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMtaProtocolPipelining(t *testing.T) {
+
+	Convey("Testing replies to pipelined commands are sent in one batch", t, func() {
+		server, client := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		proto := NewMtaProtocol(server)
+
+		go func() {
+			_, _ = client.Write([]byte("MAIL FROM:<bob@example.org>\r\nRCPT TO:<alice@example.com>\r\nNOOP\r\n"))
+		}()
+
+		for i := 0; i < 3; i++ {
+			_, err := proto.GetCmd()
+			So(err, ShouldBeNil)
+			proto.Send(Answer{Status: Ok, Message: "OK"})
+		}
+
+		// The next read blocks, so all replies should be flushed now.
+		go func() {
+			_, _ = proto.GetCmd()
+		}()
+
+		buffer := make([]byte, 1024)
+		n, err := client.Read(buffer)
+		So(err, ShouldBeNil)
+		So(string(buffer[:n]), ShouldEqual, "250 OK\r\n250 OK\r\n250 OK\r\n")
+	})
+
+	Convey("Testing replies are flushed when closing the connection", t, func() {
+		server, client := net.Pipe()
+		defer client.Close()
+
+		proto := NewMtaProtocol(server)
+
+		go func() {
+			proto.Send(Answer{Status: Closing, Message: "Bye!"})
+			proto.Close()
+		}()
+
+		buffer := make([]byte, 1024)
+		n, err := client.Read(buffer)
+		So(err, ShouldBeNil)
+		So(string(buffer[:n]), ShouldEqual, "221 Bye!\r\n")
+	})
+}
+
+// newTestCertificate creates a certificate signed by parent, or a self-signed CA if parent is nil.
+func newTestCertificate(commonName string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		panic(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestMtaProtocolStartTls(t *testing.T) {
+
+	Convey("Testing the verified client certificate is exposed after STARTTLS", t, func() {
+		ca := newTestCertificate("Test CA", nil)
+		serverCert := newTestCertificate("mx.example.com", &ca)
+		clientCert := newTestCertificate("client.example.com", &ca)
+
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.Leaf)
+
+		server, client := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		proto := NewMtaProtocol(server)
+
+		errC := make(chan error)
+		go func() {
+			tlsClient := tls.Client(client, &tls.Config{
+				RootCAs:      pool,
+				ServerName:   "mx.example.com",
+				Certificates: []tls.Certificate{clientCert},
+			})
+			errC <- tlsClient.Handshake()
+		}()
+
+		err := proto.StartTls(&tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		})
+		So(err, ShouldBeNil)
+		So(<-errC, ShouldBeNil)
+
+		state := proto.GetState()
+		So(state.TLSState, ShouldNotBeNil)
+		So(state.VerifiedChains, ShouldHaveLength, 1)
+		So(state.VerifiedChains[0][0].Subject.CommonName, ShouldEqual, "client.example.com")
+		So(state.VerifiedChains[0][1].Subject.CommonName, ShouldEqual, "Test CA")
+	})
+}
+
+func TestEnhancedCode(t *testing.T) {
+
+	Convey("Testing answers with enhanced status codes", t, func() {
+		answer := Answer{Status: 535, EnhancedCode: EnhancedCode{5, 7, 8}, Message: "Authentication credentials invalid"}
+		So(answer.String(), ShouldEqual, "535 5.7.8 Authentication credentials invalid")
+
+		answer = Answer{Status: 220, Message: "Service Ready"}
+		So(answer.String(), ShouldEqual, "220 Service Ready")
+
+		multi := MultiAnswer{Status: 553, EnhancedCode: EnhancedCode{5, 1, 4}, Messages: []string{"Ambiguous;", "<a@example.com>"}}
+		So(multi.String(), ShouldEqual, "553-5.1.4 Ambiguous;\r\n553 5.1.4 <a@example.com>")
+
+		So(SMTPErrorPermanentExceededStorage.Error(), ShouldEqual, `smtp error 552 5.2.2 "Requested mail action aborted: exceeded storage allocation"`)
+	})
+
+	Convey("Testing ParseEnhancedCode()", t, func() {
+		code, err := ParseEnhancedCode("5.7.8")
+		So(err, ShouldBeNil)
+		So(code, ShouldEqual, EnhancedCode{5, 7, 8})
+
+		code, err = ParseEnhancedCode("4.7.10")
+		So(err, ShouldBeNil)
+		So(code, ShouldEqual, EnhancedCode{4, 7, 10})
+
+		for _, invalid := range []string{"", "5.7", "3.0.0", "5.a.1", "5.1.1000", "5..1"} {
+			_, err = ParseEnhancedCode(invalid)
+			So(err, ShouldBeError)
+		}
+	})
+}
+
+func TestMtaProtocolWatchDisconnect(t *testing.T) {
+
+	Convey("Testing the context is cancelled when the client disconnects", t, func() {
+		server, client := net.Pipe()
+		defer server.Close()
+
+		proto := NewMtaProtocol(server)
+		ctx, stop := proto.WatchDisconnect(context.Background())
+		defer stop()
+
+		client.Close()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+		So(ctx.Err(), ShouldEqual, context.Canceled)
+	})
+
+	Convey("Testing pipelined commands are kept after stopping the watch", t, func() {
+		server, client := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		proto := NewMtaProtocol(server)
+		ctx, stop := proto.WatchDisconnect(context.Background())
+
+		go func() {
+			_, _ = client.Write([]byte("NOOP\r\n"))
+		}()
+		// Give the watch some time to peek at the command.
+		time.Sleep(10 * time.Millisecond)
+		stop()
+		So(ctx.Err(), ShouldEqual, context.Canceled)
+
+		cmd, err := proto.GetCmd()
+		So(err, ShouldBeNil)
+		So(*cmd, ShouldHaveSameTypeAs, NoopCmd{})
+	})
+
+	Convey("Testing commands can be read after stopping an idle watch", t, func() {
+		server, client := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		proto := NewMtaProtocol(server)
+		_, stop := proto.WatchDisconnect(context.Background())
+		stop()
+
+		go func() {
+			_, _ = client.Write([]byte("QUIT\r\n"))
+		}()
+
+		cmd, err := proto.GetCmd()
+		So(err, ShouldBeNil)
+		So(*cmd, ShouldHaveSameTypeAs, QuitCmd{})
+	})
+}
+
+func TestMtaProtocolTimeout(t *testing.T) {
+
+	Convey("Testing a command times out", t, func() {
+		server, client := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		proto := NewMtaProtocol(server)
+		proto.SetTimeout(50 * time.Millisecond)
+
+		_, err := proto.GetCmd()
+		So(err, ShouldEqual, ErrTimeout)
+	})
+
+	Convey("Testing the message data times out", t, func() {
+		server, client := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		go func() {
+			_, _ = client.Write([]byte("DATA\r\nSome "))
+		}()
+
+		proto := NewMtaProtocol(server)
+		proto.SetTimeout(50 * time.Millisecond)
+
+		cmd, err := proto.GetCmd()
+		So(err, ShouldBeNil)
+		data := (*cmd).(DataCmd)
+		_, err = io.ReadAll(&data.R)
+		So(err, ShouldEqual, ErrTimeout)
+	})
+
+	Convey("Testing reads fail after the deadline", t, func() {
+		server, client := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		go func() {
+			_, _ = client.Write([]byte("NOOP\r\n"))
+		}()
+
+		proto := NewMtaProtocol(server)
+		proto.SetTimeout(time.Minute)
+		proto.SetDeadline(time.Now().Add(50 * time.Millisecond))
+
+		_, err := proto.GetCmd()
+		So(err, ShouldBeNil)
+		_, err = proto.GetCmd()
+		So(err, ShouldEqual, ErrTimeout)
+	})
+
+	Convey("Testing the watch for a disconnect doesn't time out", t, func() {
+		server, client := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		proto := NewMtaProtocol(server)
+		proto.SetTimeout(10 * time.Millisecond)
+		ctx, stop := proto.WatchDisconnect(context.Background())
+		time.Sleep(50 * time.Millisecond)
+		So(ctx.Err(), ShouldBeNil)
+		stop()
+
+		_, err := proto.GetCmd()
+		So(err, ShouldEqual, ErrTimeout)
+	})
+}
@@ -0,0 +1,264 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyHeader is the header of the PROXY protocol (version 1 or 2) which a load balancer
+// sends at the start of a connection to pass the address of the original client.
+// See https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+type ProxyHeader struct {
+	Version int
+	// Local is set for connections of the proxy itself, e.g. health checks.
+	// The addresses are then nil.
+	Local bool
+	// SourceAddr and DestinationAddr are the addresses of the original connection,
+	// nil if the proxy didn't know them.
+	SourceAddr      *net.TCPAddr
+	DestinationAddr *net.TCPAddr
+	// TLVs are the additional fields of a version 2 header.
+	TLVs []ProxyTLV
+}
+
+// ProxyTLV is a type-length-value field of a version 2 PROXY header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Types of ProxyTLV
+const (
+	ProxyTLVTypeALPN      byte = 0x01
+	ProxyTLVTypeAuthority byte = 0x02
+	ProxyTLVTypeCRC32C    byte = 0x03
+	ProxyTLVTypeNoop      byte = 0x04
+	ProxyTLVTypeUniqueId  byte = 0x05
+	ProxyTLVTypeSSL       byte = 0x20
+	ProxyTLVTypeNetNS     byte = 0x30
+)
+
+// ErrNoProxyHeader is returned when a connection doesn't start with a PROXY header.
+var ErrNoProxyHeader = errors.New("no PROXY protocol header")
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// The maximum length of a version 1 header including the CRLF.
+	proxyV1MaxLength = 107
+	// The length of the fixed part of a version 2 header.
+	proxyV2HeaderLength = 16
+)
+
+// ReadProxyHeader reads a version 1 or version 2 PROXY header.
+func ReadProxyHeader(br *bufio.Reader) (*ProxyHeader, error) {
+	// Both versions are at least as long as the signature of version 2.
+	signature, err := br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(signature, proxyV1Prefix):
+		return readProxyHeaderV1(br)
+	case bytes.Equal(signature, proxyV2Signature):
+		return readProxyHeaderV2(br)
+	default:
+		return nil, ErrNoProxyHeader
+	}
+}
+
+// readProxyHeaderV1 reads the human-readable header:
+// "PROXY" SP ( "TCP4" / "TCP6" ) SP srcip SP dstip SP srcport SP dstport CRLF
+// or "PROXY UNKNOWN" followed by anything until CRLF.
+func readProxyHeaderV1(br *bufio.Reader) (*ProxyHeader, error) {
+	line, err := ReadUntill('\n', proxyV1MaxLength, br)
+	if err != nil {
+		if err == ErrLtl {
+			return nil, fmt.Errorf("PROXY header too long")
+		}
+		return nil, err
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY header doesn't end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY header: %q", line)
+	}
+
+	header.SourceAddr, err = parseProxyAddr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	header.DestinationAddr, err = parseProxyAddr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func parseProxyAddr(protocol string, ip string, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (protocol == "TCP4") != (addr.To4() != nil) {
+		return nil, fmt.Errorf("invalid address in PROXY header: %q", ip)
+	}
+	// Ports are decimal numbers without leading zeroes.
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("invalid port in PROXY header: %q", port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// readProxyHeaderV2 reads the binary header: the signature, the version and command,
+// the address family and protocol, the length of the rest, the addresses and the TLVs.
+func readProxyHeaderV2(br *bufio.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, proxyV2HeaderLength)
+	_, err := io.ReadFull(br, fixed)
+	if err != nil {
+		return nil, err
+	}
+
+	versionCommand, family := fixed[12], fixed[13]
+	length := binary.BigEndian.Uint16(fixed[14:16])
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", versionCommand>>4)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(br, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &ProxyHeader{Version: 2}
+	switch versionCommand & 0x0f {
+	case 0x0:
+		// LOCAL: the addresses must be ignored.
+		header.Local = true
+		return header, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY command %d", versionCommand&0x0f)
+	}
+
+	var addressLength int
+	switch family {
+	case 0x11, 0x12:
+		// TCP or UDP over IPv4: 4 bytes per address and 2 bytes per port.
+		addressLength = 12
+		if len(payload) < addressLength {
+			return nil, fmt.Errorf("PROXY header too short for IPv4 addresses")
+		}
+		header.SourceAddr = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		header.DestinationAddr = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case 0x21, 0x22:
+		// TCP or UDP over IPv6: 16 bytes per address and 2 bytes per port.
+		addressLength = 36
+		if len(payload) < addressLength {
+			return nil, fmt.Errorf("PROXY header too short for IPv6 addresses")
+		}
+		header.SourceAddr = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		header.DestinationAddr = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	case 0x31, 0x32:
+		// Unix sockets: 108 bytes per path, the client has no ip.
+		addressLength = 216
+		if len(payload) < addressLength {
+			return nil, fmt.Errorf("PROXY header too short for unix addresses")
+		}
+	case 0x00:
+		// UNSPEC: the addresses are unknown.
+	default:
+		return nil, fmt.Errorf("unsupported PROXY address family %#x", family)
+	}
+
+	header.TLVs, err = parseProxyTLVs(payload[addressLength:])
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func parseProxyTLVs(data []byte) ([]ProxyTLV, error) {
+	tlvs := []ProxyTLV{}
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, fmt.Errorf("invalid TLV in PROXY header")
+		}
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return nil, fmt.Errorf("invalid TLV in PROXY header")
+		}
+		tlvs = append(tlvs, ProxyTLV{Type: data[0], Value: data[3 : 3+length]})
+		data = data[3+length:]
+	}
+	return tlvs, nil
+}
+
+// ProxyConn is a connection of a load balancer which started with a PROXY header.
+// RemoteAddr and LocalAddr return the addresses of the original connection if they are known.
+type ProxyConn struct {
+	net.Conn
+	br     *bufio.Reader
+	Header *ProxyHeader
+}
+
+// NewProxyConn reads the PROXY header of the connection.
+func NewProxyConn(c net.Conn) (*ProxyConn, error) {
+	br := bufio.NewReader(c)
+	header, err := ReadProxyHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyConn{Conn: c, br: br, Header: header}, nil
+}
+
+// Read reads from the connection after the PROXY header.
+func (c *ProxyConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
+
+// RemoteAddr returns the address of the original client.
+func (c *ProxyConn) RemoteAddr() net.Addr {
+	if c.Header.SourceAddr != nil {
+		return c.Header.SourceAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the original client connected to.
+func (c *ProxyConn) LocalAddr() net.Addr {
+	if c.Header.DestinationAddr != nil {
+		return c.Header.DestinationAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// proxyHeaderOf returns the PROXY header of the connection, also if it is wrapped in TLS.
+func proxyHeaderOf(c net.Conn) *ProxyHeader {
+	if tlsCon, ok := c.(*tls.Conn); ok {
+		c = tlsCon.NetConn()
+	}
+	if proxyCon, ok := c.(*ProxyConn); ok {
+		return proxyCon.Header
+	}
+	return nil
+}
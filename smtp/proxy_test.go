@@ -0,0 +1,109 @@
+package smtp
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProxyHeader(t *testing.T) {
+
+	Convey("Testing ReadProxyHeader() with version 1 headers", t, func() {
+		br := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\nEHLO"))
+		header, err := ReadProxyHeader(br)
+		So(err, ShouldBeNil)
+		So(header.Version, ShouldEqual, 1)
+		So(header.SourceAddr.String(), ShouldEqual, "192.0.2.1:56324")
+		So(header.DestinationAddr.String(), ShouldEqual, "198.51.100.1:25")
+		rest, _ := br.ReadString('\n')
+		So(rest, ShouldEqual, "EHLO")
+
+		br = bufio.NewReader(strings.NewReader("PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\n"))
+		header, err = ReadProxyHeader(br)
+		So(err, ShouldBeNil)
+		So(header.SourceAddr.String(), ShouldEqual, "[2001:db8::1]:56324")
+
+		br = bufio.NewReader(strings.NewReader("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"))
+		header, err = ReadProxyHeader(br)
+		So(err, ShouldBeNil)
+		So(header.SourceAddr, ShouldBeNil)
+
+		invalid := []string{
+			"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+			"PROXY TCP4 2001:db8::1 198.51.100.1 56324 25\r\n",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 056324 25\r\n",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 65536 25\r\n",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\n",
+			"PROXY UDP4 192.0.2.1 198.51.100.1 56324 25\r\n",
+			"PROXY " + strings.Repeat("x", 200) + "\r\n",
+		}
+		for _, header := range invalid {
+			_, err = ReadProxyHeader(bufio.NewReader(strings.NewReader(header)))
+			So(err, ShouldNotBeNil)
+		}
+
+		_, err = ReadProxyHeader(bufio.NewReader(strings.NewReader("EHLO some.sender\r\n")))
+		So(err, ShouldEqual, ErrNoProxyHeader)
+	})
+
+	Convey("Testing ReadProxyHeader() with version 2 headers", t, func() {
+		message := string(proxyV2Signature) +
+			"\x21\x11\x00\x12" + // PROXY, TCP over IPv4, 18 bytes
+			"\xc0\x00\x02\x01" + "\xc6\x33\x64\x01" + "\xdc\x04" + "\x00\x19" +
+			"\x05\x00\x03abc" + // unique id TLV
+			"EHLO"
+		br := bufio.NewReader(strings.NewReader(message))
+		header, err := ReadProxyHeader(br)
+		So(err, ShouldBeNil)
+		So(header.Version, ShouldEqual, 2)
+		So(header.Local, ShouldBeFalse)
+		So(header.SourceAddr.String(), ShouldEqual, "192.0.2.1:56324")
+		So(header.DestinationAddr.String(), ShouldEqual, "198.51.100.1:25")
+		So(header.TLVs, ShouldResemble, []ProxyTLV{{Type: ProxyTLVTypeUniqueId, Value: []byte("abc")}})
+		rest, _ := br.ReadString('\n')
+		So(rest, ShouldEqual, "EHLO")
+
+		// LOCAL command of a health check
+		br = bufio.NewReader(strings.NewReader(string(proxyV2Signature) + "\x20\x00\x00\x00"))
+		header, err = ReadProxyHeader(br)
+		So(err, ShouldBeNil)
+		So(header.Local, ShouldBeTrue)
+		So(header.SourceAddr, ShouldBeNil)
+
+		invalid := []string{
+			string(proxyV2Signature) + "\x11\x11\x00\x0c" + strings.Repeat("\x00", 12),
+			string(proxyV2Signature) + "\x22\x11\x00\x0c" + strings.Repeat("\x00", 12),
+			string(proxyV2Signature) + "\x21\x11\x00\x04" + strings.Repeat("\x00", 4),
+			string(proxyV2Signature) + "\x21\x11\x00\x0e" + strings.Repeat("\x00", 12) + "\x05\x00",
+			string(proxyV2Signature) + "\x21\x11\x00\x0c" + strings.Repeat("\x00", 4),
+		}
+		for _, header := range invalid {
+			_, err = ReadProxyHeader(bufio.NewReader(strings.NewReader(header)))
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Testing ProxyConn", t, func() {
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go func() {
+			_, _ = client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\nQUIT\r\n"))
+		}()
+
+		proxyCon, err := NewProxyConn(server)
+		So(err, ShouldBeNil)
+
+		proto := NewMtaProtocol(proxyCon)
+		So(proto.GetIP().String(), ShouldEqual, "192.0.2.1")
+		So(proto.GetState().Proxy, ShouldEqual, proxyCon.Header)
+		So(proxyCon.LocalAddr().String(), ShouldEqual, "198.51.100.1:25")
+
+		cmd, err := proto.GetCmd()
+		So(err, ShouldBeNil)
+		So(*cmd, ShouldHaveSameTypeAs, QuitCmd{})
+	})
+}
@@ -2,12 +2,16 @@ package smtp
 
 import "fmt"
 
-// SMTPError describes an SMTP error with a Status and a Message
+// SMTPError describes an SMTP error with a Status, an optional EnhancedCode and a Message
 // list of SMTP errors: https://datatracker.ietf.org/doc/html/rfc5321#section-4.2.3
+// list of enhanced status codes: https://datatracker.ietf.org/doc/html/rfc3463
 type SMTPError Answer
 
 func (err SMTPError) Error() string {
-	return fmt.Sprintf("smtp error %d %q", err.Status, err.Message)
+	if err.EnhancedCode.IsZero() {
+		return fmt.Sprintf("smtp error %d %q", err.Status, err.Message)
+	}
+	return fmt.Sprintf("smtp error %d %s %q", err.Status, err.EnhancedCode, err.Message)
 }
 
 var (
@@ -25,11 +29,11 @@ var (
 	// change in command form or in properties of the sender or receiver
 	// (that is, the command is repeated identically and the receiver
 	// does not put up a new implementation).
-	SMTPErrorTransientServiceNotAvailable           = SMTPError{Status: 421, Message: "Service not available, closing transmission channel"}
-	SMTPErrorTransientMailboxNotAvailable           = SMTPError{Status: 450, Message: "Requested mail action not taken: mailbox unavailable"}
-	SMTPErrorTransientLocalError                    = SMTPError{Status: 451, Message: "Requested action aborted: local error in processing"}
-	SMTPErrorTransientInsufficientSystemStorage     = SMTPError{Status: 452, Message: "Requested action not taken: insufficient system storage"}
-	SMTPErrorTransientUnableToAccommodateParameters = SMTPError{Status: 455, Message: "Server unable to accommodate parameters"}
+	SMTPErrorTransientServiceNotAvailable           = SMTPError{Status: 421, EnhancedCode: EnhancedCode{4, 3, 2}, Message: "Service not available, closing transmission channel"}
+	SMTPErrorTransientMailboxNotAvailable           = SMTPError{Status: 450, EnhancedCode: EnhancedCode{4, 2, 0}, Message: "Requested mail action not taken: mailbox unavailable"}
+	SMTPErrorTransientLocalError                    = SMTPError{Status: 451, EnhancedCode: EnhancedCode{4, 3, 0}, Message: "Requested action aborted: local error in processing"}
+	SMTPErrorTransientInsufficientSystemStorage     = SMTPError{Status: 452, EnhancedCode: EnhancedCode{4, 3, 1}, Message: "Requested action not taken: insufficient system storage"}
+	SMTPErrorTransientUnableToAccommodateParameters = SMTPError{Status: 455, EnhancedCode: EnhancedCode{4, 5, 4}, Message: "Server unable to accommodate parameters"}
 
 	// 5yz  Permanent Negative Completion reply
 	// The command was not accepted and the requested action did not
@@ -39,15 +43,15 @@ var (
 	// reinitiate the command sequence by direct action at some point in
 	// the future (e.g., after the spelling has been changed, or the user
 	// has altered the account status).
-	SMTPErrorPermanentSyntaxError             = SMTPError{Status: 500, Message: "Syntax error, command unrecognized"}
-	SMTPErrorPermanentSyntaxErrorInParameters = SMTPError{Status: 501, Message: "Syntax error in parameters or arguments"}
-	SMTPErrorPermanentCommandNotImplemented   = SMTPError{Status: 502, Message: "Command not implemented"}
-	SMTPErrorPermanentBadSequence             = SMTPError{Status: 503, Message: "Bad sequence of commands"}
-	SMTPErrorPermanentParameterNotImplemented = SMTPError{Status: 504, Message: "Command parameter not implemented"}
-	SMTPErrorPermanentMailboxNotAvailable     = SMTPError{Status: 550, Message: "Requested action not taken: mailbox unavailable"}
-	SMTPErrorPermanentUserNotLocal            = SMTPError{Status: 551, Message: "User not local"}
-	SMTPErrorPermanentExceededStorage         = SMTPError{Status: 552, Message: "Requested mail action aborted: exceeded storage allocation"}
-	SMTPErrorPermanentMailboxNameNotAllowed   = SMTPError{Status: 553, Message: "Requested action not taken: mailbox name not allowed"}
-	SMTPErrorPermanentTransactionFailed       = SMTPError{Status: 554, Message: "Transaction failed"}
-	SMTPErrorMailParametersNotImplemented     = SMTPError{Status: 555, Message: "MAIL FROM/RCPT TO parameters not recognized or not implemented"}
+	SMTPErrorPermanentSyntaxError             = SMTPError{Status: 500, EnhancedCode: EnhancedCode{5, 5, 2}, Message: "Syntax error, command unrecognized"}
+	SMTPErrorPermanentSyntaxErrorInParameters = SMTPError{Status: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Syntax error in parameters or arguments"}
+	SMTPErrorPermanentCommandNotImplemented   = SMTPError{Status: 502, EnhancedCode: EnhancedCode{5, 5, 1}, Message: "Command not implemented"}
+	SMTPErrorPermanentBadSequence             = SMTPError{Status: 503, EnhancedCode: EnhancedCode{5, 5, 1}, Message: "Bad sequence of commands"}
+	SMTPErrorPermanentParameterNotImplemented = SMTPError{Status: 504, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Command parameter not implemented"}
+	SMTPErrorPermanentMailboxNotAvailable     = SMTPError{Status: 550, EnhancedCode: EnhancedCode{5, 1, 1}, Message: "Requested action not taken: mailbox unavailable"}
+	SMTPErrorPermanentUserNotLocal            = SMTPError{Status: 551, EnhancedCode: EnhancedCode{5, 1, 6}, Message: "User not local"}
+	SMTPErrorPermanentExceededStorage         = SMTPError{Status: 552, EnhancedCode: EnhancedCode{5, 2, 2}, Message: "Requested mail action aborted: exceeded storage allocation"}
+	SMTPErrorPermanentMailboxNameNotAllowed   = SMTPError{Status: 553, EnhancedCode: EnhancedCode{5, 1, 3}, Message: "Requested action not taken: mailbox name not allowed"}
+	SMTPErrorPermanentTransactionFailed       = SMTPError{Status: 554, EnhancedCode: EnhancedCode{5, 0, 0}, Message: "Transaction failed"}
+	SMTPErrorMailParametersNotImplemented     = SMTPError{Status: 555, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "MAIL FROM/RCPT TO parameters not recognized or not implemented"}
 )
@@ -3,6 +3,8 @@ package smtp
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"strings"
@@ -10,14 +12,28 @@ import (
 
 // State contains all the state for a single client
 type State struct {
-	From          *MailAddress
-	To            []*MailAddress
-	Data          []byte
-	EightBitMIME  bool
-	Secure        bool
-	SessionId     Id
-	Ip            net.IP
-	Hostname      string
+	// The domains of From and To are in their A-label form, see MailAddress.NormalizeDomain.
+	From           *MailAddress
+	To             []*Recipient
+	Data           []byte
+	EightBitMIME   bool
+	BinaryMIME     bool
+	SMTPUTF8       bool
+	DSNReturn      DSNReturn
+	EnvelopeId     string
+	RequireTLS     bool
+	Priority       Priority
+	DeliverBy      *DeliverBy
+	Secure         bool
+	TLSState       *tls.ConnectionState
+	VerifiedChains [][]*x509.Certificate
+	SessionId      Id
+	Ip             net.IP
+	Hostname       string
+	// ReverseName is the reverse DNS name of the client, only known when set by a trusted proxy.
+	ReverseName string
+	// Proxy is the PROXY protocol header of the load balancer, nil if the client connected directly.
+	Proxy         *ProxyHeader
 	Authenticated bool
 	User          User
 }
@@ -31,9 +47,16 @@ type User interface {
 // reset the state
 func (s *State) Reset() {
 	s.From = nil
-	s.To = []*MailAddress{}
+	s.To = []*Recipient{}
 	s.Data = []byte{}
 	s.EightBitMIME = false
+	s.BinaryMIME = false
+	s.SMTPUTF8 = false
+	s.DSNReturn = ""
+	s.EnvelopeId = ""
+	s.RequireTLS = false
+	s.Priority = 0
+	s.DeliverBy = nil
 }
 
 // Checks the state if the client can send a MAIL command.
@@ -74,7 +97,7 @@ func (s *State) AuthMatchesRcptAndMail() (bool, string) {
 
 	// TODO: handle if user can send from multiple email addresses
 	if s.From.Address != s.User.Username() {
-		return false, fmt.Sprintf("5.7.1 Sender address rejected: not owned by user %s", s.User.Username())
+		return false, fmt.Sprintf("Sender address rejected: not owned by user %s", s.User.Username())
 	}
 
 	// TODO: check for recipient?